@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	neturl "net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// Auth holds what is needed to authenticate each worker's browser before it loads any targets
+type Auth struct {
+	Cookies []*network.CookieParam
+
+	// Headers are only added to requests to Hosts, so that credentials aren't sent to third
+	// parties such as CDNs
+	Headers network.Headers
+	Hosts   map[string]bool
+
+	// Login is run when each worker starts, and again whenever the session expires
+	Login *Macro
+
+	// The session is considered to have expired if loading CheckURL redirects elsewhere, or if
+	// an element matching CheckSelector is found. If CheckURL isn't given, CheckSelector is
+	// looked for on each target instead.
+	CheckURL      string
+	CheckSelector string
+}
+
+// loadAuth reads the cookies, headers and login macro given in the config
+func loadAuth(c *config.Config) (*Auth, error) {
+	a := &Auth{
+		Headers:       network.Headers{},
+		Hosts:         make(map[string]bool),
+		CheckURL:      c.SessionCheckURL,
+		CheckSelector: c.SessionCheckSelector,
+	}
+
+	if c.CookiesFile != "" {
+		var err error
+		if a.Cookies, err = loadCookies(c.CookiesFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, h := range c.Headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, headers should be given as 'Name: value'", h)
+		}
+		a.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	if c.LoginFile != "" {
+		b, err := ioutil.ReadFile(c.LoginFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read login macro: %v", err)
+		}
+		a.Login = &Macro{}
+		if err := json.Unmarshal(b, a.Login); err != nil {
+			return nil, fmt.Errorf("failed to parse login macro: %v", err)
+		}
+		for i, s := range a.Login.Steps {
+			if err := s.validate(); err != nil {
+				return nil, fmt.Errorf("invalid step %d of login macro: %v", i+1, err)
+			}
+		}
+	}
+
+	if len(a.Headers) > 0 {
+		if err := a.addHosts(c); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// addHosts adds the hosts of the targets, the session check URL and any pages the login macro
+// navigates to to the hosts which extra headers are sent to
+func (a *Auth) addHosts(c *config.Config) error {
+	urls := []string{c.SessionCheckURL}
+	if a.Login != nil {
+		for _, s := range a.Login.Steps {
+			urls = append(urls, s.Navigate)
+		}
+	}
+
+	f, err := os.Open(c.URLsFile)
+	if err != nil {
+		return fmt.Errorf("failed to open targets file: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		urls = append(urls, targetURL(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read targets file: %v", err)
+	}
+
+	for _, s := range urls {
+		// Relative URLs in the login macro stay on a host which has already been added
+		if u, err := neturl.Parse(s); err == nil && u.Hostname() != "" {
+			a.Hosts[u.Hostname()] = true
+		}
+	}
+	return nil
+}
+
+// jsonCookie is a cookie exported as JSON, either by the DevTools protocol or by browser
+// extensions, which use expirationDate and hostOnly rather than expires
+type jsonCookie struct {
+	Name           string  `json:"name"`
+	Value          string  `json:"value"`
+	Domain         string  `json:"domain"`
+	Path           string  `json:"path"`
+	Secure         bool    `json:"secure"`
+	HTTPOnly       bool    `json:"httpOnly"`
+	SameSite       string  `json:"sameSite"`
+	Expires        float64 `json:"expires"`
+	ExpirationDate float64 `json:"expirationDate"`
+	Session        bool    `json:"session"`
+	HostOnly       bool    `json:"hostOnly"`
+}
+
+// loadCookies reads cookies from a file in either the Netscape cookies.txt format or JSON
+func loadCookies(p string) ([]*network.CookieParam, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cookies file: %v", err)
+	}
+
+	var ret []*network.CookieParam
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		var cookies []jsonCookie
+		if err := json.Unmarshal(b, &cookies); err != nil {
+			return nil, fmt.Errorf("failed to parse cookies file: %v", err)
+		}
+		for _, c := range cookies {
+			expires := c.Expires
+			if expires == 0 {
+				expires = c.ExpirationDate
+			}
+			if c.Session {
+				expires = 0
+			}
+			ret = append(ret, cookieParam(c.Name, c.Value, c.Domain, c.Path, !c.HostOnly, c.Secure, c.HTTPOnly, c.SameSite, expires))
+		}
+		return ret, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		// curl and others mark HttpOnly cookies with a prefix rather than a field
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("failed to parse line %d of cookies file: expected 7 tab separated fields", n)
+		}
+		expires, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse expiry on line %d of cookies file: %v", n, err)
+		}
+		domain, subdomains, path, secure := fields[0], fields[1] == "TRUE", fields[2], fields[3] == "TRUE"
+		ret = append(ret, cookieParam(fields[5], fields[6], domain, path, subdomains, secure, httpOnly, "", expires))
+	}
+	return ret, nil
+}
+
+// cookieParam builds the parameters to set a cookie. Cookies which aren't sent to subdomains are
+// set with a URL rather than a domain, which makes them host-only.
+func cookieParam(name, value, domain, path string, subdomains, secure, httpOnly bool, sameSite string, expires float64) *network.CookieParam {
+	c := &network.CookieParam{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Secure:   secure,
+		HTTPOnly: httpOnly,
+	}
+	if subdomains {
+		c.Domain = domain
+	} else {
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		c.URL = scheme + "://" + strings.TrimPrefix(domain, ".") + path
+	}
+
+	switch strings.ToLower(sameSite) {
+	case "strict":
+		c.SameSite = network.CookieSameSiteStrict
+	case "lax":
+		c.SameSite = network.CookieSameSiteLax
+	case "none", "no_restriction":
+		c.SameSite = network.CookieSameSiteNone
+	}
+
+	if expires > 0 {
+		t := cdp.TimeSinceEpoch(time.Unix(int64(expires), 0))
+		c.Expires = &t
+	}
+	return c
+}
+
+// authenticate imports cookies, sets extra headers and logs in for the worker. It is called
+// once for each worker before it loads any targets.
+func (w *Worker) authenticate(errorChan chan<- error) error {
+	ctx := *w.ctx
+	if len(w.auth.Cookies) > 0 {
+		if err := chromedp.Run(ctx, network.SetCookies(w.auth.Cookies)); err != nil {
+			return fmt.Errorf("failed to import cookies: %v", err)
+		}
+	}
+	if len(w.auth.Headers) > 0 && len(w.auth.Hosts) > 0 {
+		if err := w.interceptHeaders(ctx, errorChan); err != nil {
+			return fmt.Errorf("failed to set extra headers: %v", err)
+		}
+	}
+	if w.auth.Login != nil {
+		return w.login(ctx, errorChan)
+	}
+	return nil
+}
+
+// interceptHeaders adds the extra headers to requests made by the worker's tab to the hosts in
+// scope. Network.setExtraHTTPHeaders can't be used, as it adds them to every request. Only
+// requests to the hosts in scope are intercepted, although the patterns can match other URLs,
+// so the host is checked again before the headers are added.
+func (w *Worker) interceptHeaders(ctx context.Context, errorChan chan<- error) error {
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		e, ok := ev.(*fetch.EventRequestPaused)
+		if !ok {
+			return
+		}
+		go func() {
+			u, err := neturl.Parse(e.Request.URL)
+			if err != nil || !w.auth.Hosts[u.Hostname()] {
+				if err := chromedp.Run(ctx, fetch.ContinueRequest(e.RequestID)); err != nil && ctx.Err() == nil {
+					errorChan <- fmt.Errorf("failed to continue request to %s: %v", e.Request.URL, err)
+				}
+				return
+			}
+			c := fetch.ContinueRequest(e.RequestID).WithHeaders(w.auth.requestHeaders(e.Request.Headers))
+			if err := chromedp.Run(ctx, c); err != nil && ctx.Err() == nil {
+				// Let the request through without the headers rather than leaving it paused
+				errorChan <- fmt.Errorf("failed to add extra headers to request to %s: %v", e.Request.URL, err)
+				chromedp.Run(ctx, fetch.ContinueRequest(e.RequestID))
+			}
+		}()
+	})
+
+	var patterns []*fetch.RequestPattern
+	for h := range w.auth.Hosts {
+		patterns = append(patterns,
+			&fetch.RequestPattern{URLPattern: "*://" + h + "/*"},
+			&fetch.RequestPattern{URLPattern: "*://" + h + ":*/*"},
+		)
+	}
+	return chromedp.Run(ctx, fetch.Enable().WithPatterns(patterns))
+}
+
+// requestHeaders returns the headers of a request with the extra headers added, replacing any
+// existing headers with the same names
+func (a *Auth) requestHeaders(h network.Headers) []*fetch.HeaderEntry {
+	var ret []*fetch.HeaderEntry
+	for k, v := range h {
+		replaced := false
+		for name := range a.Headers {
+			if strings.EqualFold(k, name) {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			ret = append(ret, &fetch.HeaderEntry{Name: k, Value: fmt.Sprint(v)})
+		}
+	}
+	for k, v := range a.Headers {
+		ret = append(ret, &fetch.HeaderEntry{Name: k, Value: fmt.Sprint(v)})
+	}
+	return ret
+}
+
+// login runs the login macro, and checks that the session is valid afterwards if a check has
+// been given. Dialogs opened while logging in are answered and logged to the login directory.
+func (w *Worker) login(ctx context.Context, errorChan chan<- error) error {
+	if w.auth.Login == nil {
+		return errors.New("the session has expired, and there is no login macro to log in again with")
+	}
+	if w.config.Verbose {
+		log.Printf("Worker %d: logging in\n", w.id)
+	}
+
+	dir := w.loginDir()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.handleDialogs(ctx, dir, errorChan)
+	if err := w.runSteps(ctx, w.auth.Login.Steps, dir); err != nil {
+		return fmt.Errorf("failed to log in: %v", err)
+	}
+
+	if w.auth.CheckURL == "" && w.auth.CheckSelector == "" {
+		return nil
+	}
+	expired, err := w.sessionExpired(ctx)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return errors.New("failed to log in: the session check still fails after running the login macro")
+	}
+	return nil
+}
+
+// loginDir returns the directory that the login macro's output is stored in
+func (w *Worker) loginDir() string {
+	dir := path.Join(w.config.OutDir, "login")
+	os.MkdirAll(dir, os.ModePerm)
+	return dir
+}
+
+// checkSession loads the session check URL before a target is loaded, and logs in again if the
+// session has expired
+func (w *Worker) checkSession(errorChan chan<- error) error {
+	ctx, cancel := context.WithCancel(*w.ctx)
+	w.handleDialogs(ctx, w.loginDir(), errorChan)
+	expired, err := w.sessionExpired(ctx)
+	cancel()
+	if err != nil || !expired {
+		return err
+	}
+	log.Printf("Worker %d: session expired, logging in again\n", w.id)
+	return w.login(*w.ctx, errorChan)
+}
+
+// sessionExpired reports whether the session has expired. If there is a check URL, it is loaded
+// first, otherwise the check selector is looked for on the current page.
+func (w *Worker) sessionExpired(ctx context.Context) (bool, error) {
+	if w.auth.CheckURL != "" {
+		if err := w.Load(w.auth.CheckURL); err != nil {
+			return false, fmt.Errorf("failed to load session check URL: %v", err)
+		}
+		var loc string
+		if err := chromedp.Run(ctx, chromedp.Location(&loc)); err != nil {
+			return false, fmt.Errorf("failed to retrieve page location: %v", err)
+		}
+		if !sameURL(loc, w.auth.CheckURL) {
+			return true, nil
+		}
+	}
+	if w.auth.CheckSelector == "" {
+		return false, nil
+	}
+
+	sel, err := json.Marshal(w.auth.CheckSelector)
+	if err != nil {
+		return false, err
+	}
+	var found bool
+	if err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf("document.querySelector(%s) !== null", sel), &found)); err != nil {
+		return false, fmt.Errorf("failed to look for session check selector: %v", err)
+	}
+	return found, nil
+}
+
+// sameURL reports whether two URLs are the same, ignoring any trailing slash and fragment
+func sameURL(a, b string) bool {
+	ua, err := neturl.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := neturl.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host && ua.RawQuery == ub.RawQuery &&
+		strings.TrimSuffix(ua.Path, "/") == strings.TrimSuffix(ub.Path, "/")
+}
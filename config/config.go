@@ -17,4 +17,31 @@ type Config struct {
 	JSPriority uint8
 	ReportFile string
 	URLsFile   string
+	Active     bool
+	Insecure   bool
+	Frames     bool
+
+	Remote      string
+	Proxy       string
+	ProxyList   string
+	ProxyBypass string
+
+	AcceptDialogs bool
+	ExerciseLimit int
+	ExerciseDepth int
+	ExerciseSkip  string
+
+	MacrosFile string
+
+	CookiesFile          string
+	Headers              []string
+	LoginFile            string
+	SessionCheckURL      string
+	SessionCheckSelector string
+
+	NetworkBodies bool
+	AllHeaders    bool
+	StorageLimit  int
+
+	ListenerEvents []string
 }
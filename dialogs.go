@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+)
+
+// Dialog is a single line of the dialogs log written for each page
+type Dialog struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Message  string    `json:"message"`
+	URL      string    `json:"url"`
+	Accepted bool      `json:"accepted"`
+}
+
+// handleDialogs answers any JavaScript dialogs opened by the page, which would otherwise stall
+// it, and logs them to dialogs.jsonl in the page's output directory. Dialogs are dismissed
+// unless --accept-dialogs is given, apart from beforeunload dialogs which are always accepted so
+// that the worker can navigate away from the page.
+func (w *Worker) handleDialogs(ctx context.Context, absDir string, errorChan chan<- error) {
+	// Start a new log rather than appending to one from a previous attempt or scan
+	p := path.Join(absDir, "dialogs.jsonl")
+	os.Remove(p)
+
+	chromedp.ListenTarget(ctx, func(e interface{}) {
+		ev, ok := e.(*page.EventJavascriptDialogOpening)
+		if !ok {
+			return
+		}
+
+		accept := w.config.AcceptDialogs || ev.Type == page.DialogTypeBeforeunload
+		go func() {
+			err := chromedp.Run(ctx, page.HandleJavaScriptDialog(accept).WithPromptText(ev.DefaultPrompt))
+			if err != nil && ctx.Err() == nil {
+				errorChan <- fmt.Errorf("failed to handle %s dialog: %v", ev.Type, err)
+			}
+		}()
+
+		if w.config.Verbose {
+			log.Printf("Worker %d: %s dialog opened by %s: %s\n", w.id, ev.Type, ev.URL, ev.Message)
+		}
+		d := Dialog{
+			Time:     time.Now(),
+			Type:     ev.Type.String(),
+			Message:  ev.Message,
+			URL:      ev.URL,
+			Accepted: accept,
+		}
+		if err := appendDialog(p, d); err != nil {
+			errorChan <- err
+		}
+	})
+}
+
+// appendDialog appends a line to the dialogs log at p
+func appendDialog(p string, d Dialog) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to encode dialog: %v", err)
+	}
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open dialogs log: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write to dialogs log: %v", err)
+	}
+	return nil
+}
@@ -26,6 +26,7 @@ require (
 	github.com/klauspost/asmfmt v1.2.0 // indirect
 	github.com/koron/iferr v0.0.0-20180615142939-bb332a3b1d91 // indirect
 	github.com/kr/pty v1.1.8 // indirect
+	github.com/mailru/easyjson v0.7.1
 	github.com/mdempsky/gocode v0.0.0-20190203001940-7fb65232883f // indirect
 	github.com/rogpeppe/go-internal v1.6.0 // indirect
 	github.com/rogpeppe/godef v1.1.1 // indirect
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// Macro is a list of steps to run on pages once they have loaded, before any tasks are run.
+// Macros without a Match pattern are run on every page, while the others are only run on pages
+// whose requested URL matches the regular expression.
+type Macro struct {
+	Match string       `json:"match,omitempty"`
+	Steps []*MacroStep `json:"steps"`
+
+	match *regexp.Regexp
+}
+
+// MacroStep is a single step of a macro. Exactly one of the action fields should be set, with
+// Text only being used alongside Type.
+type MacroStep struct {
+	// Click clicks the first element matching the selector
+	Click string `json:"click,omitempty"`
+
+	// Type types Text into the first element matching the selector
+	Type string `json:"type,omitempty"`
+	Text string `json:"text,omitempty"`
+
+	// Wait waits for an element matching the selector to be visible
+	Wait string `json:"wait,omitempty"`
+
+	// Navigate loads the URL, which may be relative to the current page
+	Navigate string `json:"navigate,omitempty"`
+
+	// JS evaluates JavaScript in the page
+	JS string `json:"js,omitempty"`
+
+	// Screenshot saves a screenshot with the given name in the macros directory of the page's
+	// output directory
+	Screenshot string `json:"screenshot,omitempty"`
+}
+
+// loadMacros reads a JSON list of macros from the file at p
+func loadMacros(p string) ([]*Macro, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read macros file: %v", err)
+	}
+	var macros []*Macro
+	if err := json.Unmarshal(b, &macros); err != nil {
+		return nil, fmt.Errorf("failed to parse macros file: %v", err)
+	}
+
+	for i, m := range macros {
+		if m.Match != "" {
+			if m.match, err = regexp.Compile(m.Match); err != nil {
+				return nil, fmt.Errorf("invalid pattern for macro %d: %v", i+1, err)
+			}
+		}
+		for j, s := range m.Steps {
+			if err := s.validate(); err != nil {
+				return nil, fmt.Errorf("invalid step %d of macro %d: %v", j+1, i+1, err)
+			}
+		}
+	}
+	return macros, nil
+}
+
+// validate checks that the step has exactly one action
+func (s *MacroStep) validate() error {
+	n := 0
+	for _, a := range []string{s.Click, s.Type, s.Wait, s.Navigate, s.JS, s.Screenshot} {
+		if a != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("steps must have exactly one of click, type, wait, navigate, js or screenshot")
+	}
+	if s.Text != "" && s.Type == "" {
+		return errors.New("text can only be given with type")
+	}
+	return nil
+}
+
+// String describes the step for logging
+func (s *MacroStep) String() string {
+	switch {
+	case s.Click != "":
+		return "click " + s.Click
+	case s.Type != "":
+		return "type into " + s.Type
+	case s.Wait != "":
+		return "wait for " + s.Wait
+	case s.Navigate != "":
+		return "navigate to " + s.Navigate
+	case s.JS != "":
+		return "run JavaScript"
+	}
+	return "screenshot " + s.Screenshot
+}
+
+// action returns the chromedp action which carries out the step, saving any screenshots in
+// absDir
+func (s *MacroStep) action(absDir string, wait time.Duration) chromedp.Action {
+	switch {
+	case s.Click != "":
+		return chromedp.Click(s.Click, chromedp.ByQuery)
+	case s.Type != "":
+		return chromedp.SendKeys(s.Type, s.Text, chromedp.ByQuery)
+	case s.Wait != "":
+		return chromedp.WaitVisible(s.Wait, chromedp.ByQuery)
+	case s.Navigate != "":
+		return chromedp.ActionFunc(func(ctx context.Context) error {
+			var loc string
+			if err := chromedp.Location(&loc).Do(ctx); err != nil {
+				return err
+			}
+			base, err := neturl.Parse(loc)
+			if err != nil {
+				return err
+			}
+			u, err := base.Parse(s.Navigate)
+			if err != nil {
+				return err
+			}
+			if err := chromedp.Navigate(u.String()).Do(ctx); err != nil {
+				return err
+			}
+			time.Sleep(wait)
+			return nil
+		})
+	case s.JS != "":
+		var ignored []byte
+		return chromedp.Evaluate(s.JS, &ignored)
+	}
+
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		var buf []byte
+		if err := chromedp.CaptureScreenshot(&buf).Do(ctx); err != nil {
+			return err
+		}
+		d := path.Join(absDir, "macros")
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			return err
+		}
+		name := filepath.Base(s.Screenshot)
+		if !strings.HasSuffix(name, ".png") {
+			name += ".png"
+		}
+		return ioutil.WriteFile(path.Join(d, name), buf, 0644)
+	})
+}
+
+// runMacros runs the steps of every macro which applies to u, in the order they were given.
+// A macro stops at the first step which fails, but later macros are still run.
+func (w *Worker) runMacros(ctx context.Context, u string, absDir string, errorChan chan<- error) {
+	for i, m := range w.macros {
+		if m.match != nil && !m.match.MatchString(u) {
+			continue
+		}
+		if err := w.runSteps(ctx, m.Steps, absDir); err != nil {
+			errorChan <- fmt.Errorf("failed to run macro %d on %s: %v", i+1, u, err)
+		}
+	}
+}
+
+// runSteps runs a list of macro steps, giving up if they take longer than the timeout
+func (w *Worker) runSteps(ctx context.Context, steps []*MacroStep, absDir string) error {
+	ctx, cancel := context.WithTimeout(ctx, w.config.Timeout)
+	defer cancel()
+
+	for _, s := range steps {
+		if w.config.Verbose {
+			log.Printf("Worker %d: macro step: %v\n", w.id, s)
+		}
+		if err := chromedp.Run(ctx, s.action(absDir, w.config.Wait)); err != nil {
+			return fmt.Errorf("failed to %v: %v", s, err)
+		}
+	}
+	return nil
+}
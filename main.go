@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -14,9 +15,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/cdproto/security"
 	"github.com/chromedp/chromedp"
 	"github.com/danielthatcher/spydom/config"
+	"github.com/danielthatcher/spydom/tasks"
 	flag "github.com/spf13/pflag"
 )
 
@@ -28,6 +31,8 @@ type Worker struct {
 	wg     *sync.WaitGroup
 	urlsWg *sync.WaitGroup
 	config *config.Config
+	macros []*Macro
+	auth   *Auth
 }
 
 // Load naviagates to the given URL, and waits for the page to load
@@ -50,14 +55,76 @@ func (w *Worker) Load(u string) error {
 	return err
 }
 
+// Reload loads u in a fresh document from within a task, sending the given referrer if it isn't
+// empty, and waits for the page to load in the same way as Load. Going through about:blank
+// first means that URLs which only differ from the current one by their fragment are loaded
+// again, rather than causing a same-document navigation. It is passed to tasks through the
+// context given to them.
+func (w *Worker) Reload(ctx context.Context, u string, referrer string) error {
+	if w.config.Verbose {
+		log.Printf("Worker %d: reloading %s\n", w.id, u)
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.config.Timeout)
+	defer cancel()
+	err := chromedp.Run(ctx, chromedp.Navigate("about:blank"), navigateWithReferrer(u, referrer))
+	if err == nil {
+		time.Sleep(w.config.Wait)
+	}
+	return err
+}
+
+// navigateWithReferrer is like chromedp.Navigate, but allows a referrer to be sent
+func navigateWithReferrer(u string, referrer string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		// Listen before navigating, as the previous document has already loaded
+		loaded := make(chan struct{}, 1)
+		lctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		chromedp.ListenTarget(lctx, func(ev interface{}) {
+			if _, ok := ev.(*page.EventLoadEventFired); ok {
+				select {
+				case loaded <- struct{}{}:
+				default:
+				}
+			}
+		})
+
+		p := page.Navigate(u)
+		if referrer != "" {
+			p = p.WithReferrer(referrer)
+		}
+		_, _, errorText, err := p.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if errorText != "" {
+			return errors.New(errorText)
+		}
+
+		select {
+		case <-loaded:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
 // Work reads URLs from the given channel, loads them, and then performs any
 // tasks on the loaded page. URLs which failed to load are sent down failureChan
 func (w *Worker) Work(urlsChan <-chan string, errorChan chan<- error, failureChan chan<- string) {
+	// requeued is a target found to have been loaded after the session expired, which is loaded
+	// again once logged in without counting as a failed attempt
+	var requeued string
 	for {
-		u, more := <-urlsChan
-		if !more {
-			w.wg.Done()
-			return
+		u, relogged := requeued, requeued != ""
+		requeued = ""
+		if !relogged {
+			var more bool
+			if u, more = <-urlsChan; !more {
+				w.wg.Done()
+				return
+			}
 		}
 
 		// Output dir
@@ -65,16 +132,54 @@ func (w *Worker) Work(urlsChan <-chan string, errorChan chan<- error, failureCha
 		absDir := path.Join(w.config.OutDir, relDir)
 		os.MkdirAll(absDir, os.ModePerm)
 
+		// Log in again before loading the target if the session has expired
+		if w.auth.CheckURL != "" {
+			if err := w.checkSession(errorChan); err != nil {
+				errorChan <- fmt.Errorf("failed to check session before loading %s: %v", u, err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(*w.ctx)
+		ctx = tasks.WithReload(ctx, w.Reload)
+		w.handleDialogs(ctx, absDir, errorChan)
+		tracker := tasks.NewFrameTracker(ctx)
+		w.preload(ctx, u, absDir, relDir, errorChan)
+
 		err := w.Load(u)
 		if err != nil {
+			w.teardown(ctx, u, absDir, relDir, errorChan)
+			tracker.Close()
+			cancel()
 			errorChan <- fmt.Errorf("failed to load %s: %v", u, err)
 			failureChan <- u
 			continue
 		}
 
+		// Without a check URL, the session can only be checked once the target has loaded, in
+		// which case it is loaded again after logging in. It is only loaded again once, so that
+		// a login macro which doesn't work can't loop forever.
+		if w.auth.CheckURL == "" && w.auth.CheckSelector != "" && !relogged {
+			if expired, err := w.sessionExpired(ctx); err != nil {
+				errorChan <- fmt.Errorf("failed to check session on %s: %v", u, err)
+			} else if expired {
+				w.teardown(ctx, u, absDir, relDir, errorChan)
+				tracker.Close()
+				cancel()
+				log.Printf("Worker %d: session expired while loading %s, logging in again\n", w.id, u)
+				if err := w.login(*w.ctx, errorChan); err != nil {
+					errorChan <- err
+				}
+				requeued = u
+				continue
+			}
+		}
+
+		w.runMacros(ctx, u, absDir, errorChan)
+
+		ctx, frames := w.discoverFrames(ctx, tracker, u, errorChan)
+
 		// Run all workers on page. Start at 0 and go to 4 in as these are valid
 		// priorities for the jsrunner module
-		ctx, cancel := context.WithCancel(*w.ctx)
 		for i := uint8(0); i <= 4; i++ {
 			for _, t := range w.tasks {
 				if t.Priority() == i {
@@ -82,14 +187,86 @@ func (w *Worker) Work(urlsChan <-chan string, errorChan chan<- error, failureCha
 					if err != nil {
 						errorChan <- fmt.Errorf("failed to run task %v: %v", t.Slug(), err)
 					}
+					if f, ok := t.(FrameTask); ok && f.PerFrame() && w.config.Frames {
+						w.runInFrames(ctx, t, tracker, frames, u, absDir, relDir, errorChan)
+					}
+
+					// Active tasks may reload the page, which replaces its frames
+					if a, ok := t.(ActiveTask); ok && a.Active() {
+						ctx, frames = w.discoverFrames(ctx, tracker, u, errorChan)
+					}
 				}
 			}
 		}
+		w.teardown(ctx, u, absDir, relDir, errorChan)
+		tracker.Close()
 		w.urlsWg.Done()
 		cancel()
 	}
 }
 
+// discoverFrames finds the frames of the page, and adds the frame tree to the context given to
+// tasks
+func (w *Worker) discoverFrames(ctx context.Context, tracker *tasks.FrameTracker, u string, errorChan chan<- error) (context.Context, []*tasks.Frame) {
+	root, frames, err := tracker.Discover(ctx)
+	if err != nil {
+		errorChan <- fmt.Errorf("failed to discover frames of %s: %v", u, err)
+		return ctx, nil
+	}
+	return tasks.WithFrameTree(ctx, root), frames
+}
+
+// runInFrames runs a task in each of the given frames, storing the output for each frame in
+// its own subdirectory
+func (w *Worker) runInFrames(ctx context.Context, t Task, tracker *tasks.FrameTracker, frames []*tasks.Frame, u string, absDir string, relDir string, errorChan chan<- error) {
+	for _, f := range frames {
+		fctx, err := tracker.WithFrame(ctx, f)
+		if err != nil {
+			errorChan <- fmt.Errorf("failed to run task %v in frame %s: %v", t.Slug(), f.URL, err)
+			continue
+		}
+
+		fabs := path.Join(absDir, f.Dir)
+		os.MkdirAll(fabs, os.ModePerm)
+		if err := t.Run(fctx, u, fabs, path.Join(relDir, f.Dir)); err != nil {
+			errorChan <- fmt.Errorf("failed to run task %v in frame %s: %v", t.Slug(), f.URL, err)
+		}
+	}
+}
+
+// preload lets any tasks which need to watch the page load set themselves up
+func (w *Worker) preload(ctx context.Context, u string, absDir string, relDir string, errorChan chan<- error) {
+	for _, t := range w.tasks {
+		if l, ok := t.(LifecycleTask); ok {
+			if err := l.Preload(ctx, u, absDir, relDir); err != nil {
+				errorChan <- fmt.Errorf("failed to prepare task %v: %v", t.Slug(), err)
+			}
+		}
+	}
+}
+
+// teardown lets any tasks which were set up by preload clean up after themselves
+func (w *Worker) teardown(ctx context.Context, u string, absDir string, relDir string, errorChan chan<- error) {
+	for _, t := range w.tasks {
+		if l, ok := t.(LifecycleTask); ok {
+			if err := l.Teardown(ctx, u, absDir, relDir); err != nil {
+				errorChan <- fmt.Errorf("failed to tear down task %v: %v", t.Slug(), err)
+			}
+		}
+	}
+}
+
+// targetURL returns the URL to load for a line of the targets file, which defaults to HTTPS
+// if no scheme is given
+func targetURL(line string) string {
+	if !targetScheme.MatchString(line) {
+		return "https://" + line
+	}
+	return line
+}
+
+var targetScheme = regexp.MustCompile("^https?://")
+
 // Returns the correct direcoty path for the given url relative to the output directory
 func getRelDir(u string) string {
 	return strings.Replace(u, "://", "-", 1)
@@ -113,15 +290,38 @@ func main() {
 	flag.DurationVarP(&conf.Timeout, "timeout", "", 10*time.Second, "The time to allow for all tasks to be run on a page before giving up")
 	flag.StringSliceVarP(&conf.Enabled, "enable", "e", nil, "Enable only the specified modules")
 	flag.StringSliceVarP(&conf.Disabled, "disable", "d", nil, "Disable these modules")
+	flag.BoolVarP(&conf.Active, "active", "", false, "Run active modules, which attack the page, as well as the passive ones")
+	flag.BoolVarP(&conf.Frames, "frames", "", false, "Also run modules which support it in every frame of the page, including out-of-process iframes")
+
+	flag.BoolVarP(&conf.AcceptDialogs, "accept-dialogs", "", false, "Accept JavaScript dialogs opened by pages, rather than dismissing them")
+	flag.IntVarP(&conf.ExerciseLimit, "exercise-limit", "", 50, "The maximum number of actions the exercise module takes on each page")
+	flag.IntVarP(&conf.ExerciseDepth, "exercise-depth", "", 2, "How many rounds of newly revealed elements the exercise module follows, where 1 only exercises the elements present once the page has loaded")
+	flag.StringVarP(&conf.ExerciseSkip, "exercise-skip", "", tasks.DefaultExerciseSkip, "A regular expression matching the text, href or form action of elements the exercise module shouldn't act on, such as logout links. Give an empty pattern to act on every element")
+
+	flag.StringVarP(&conf.MacrosFile, "macros", "", "", "A JSON file of macros to run on pages once they have loaded, before any modules are run")
+
+	flag.StringVarP(&conf.CookiesFile, "cookies", "", "", "A Netscape cookies.txt or JSON file of cookies to import into each browser before scanning")
+	flag.StringArrayVarP(&conf.Headers, "header", "H", nil, "An extra header to send with requests to the targets' hosts, in the form 'Name: value'. Can be given multiple times")
+	flag.StringVarP(&conf.LoginFile, "login", "", "", "A JSON file containing a macro which logs in, run by each worker before scanning and whenever the session expires")
+	flag.StringVarP(&conf.SessionCheckURL, "session-check-url", "", "", "A URL which redirects elsewhere when the session has expired, loaded before each target")
+	flag.StringVarP(&conf.SessionCheckSelector, "session-check-selector", "", "", "A CSS selector which only matches when logged out, such as a login form. Checked on the session check URL if one is given, otherwise on each target")
 
 	flag.StringVarP(&conf.JS, "js", "", "", "JavaScript to run with the jsrunner module")
 	flag.StringVarP(&conf.JSFile, "js-file", "", "", "A file containing JavaScript to run with the jsrunner module")
 	flag.Uint8VarP(&conf.JSPriority, "js-priority", "", 4, "The run priority for the jsrunner module, between 0 and 4. Modules with lower priorities get run sooner.")
+	flag.BoolVarP(&conf.NetworkBodies, "network-bodies", "", false, "Include response bodies in the HAR file written by the network module")
+	flag.BoolVarP(&conf.AllHeaders, "all-headers", "", false, "Save the response headers of every subresource with the headers module, rather than just the page")
+	flag.IntVarP(&conf.StorageLimit, "storage-limit", "", 100, "The maximum number of records to save from each IndexedDB object store, and of entries to list from each cache, with the indexeddb module")
+	flag.StringSliceVarP(&conf.ListenerEvents, "listeners", "", []string{"message", "hashchange"}, "Event types to extract listeners for, each of which becomes its own module. Use 'all' to extract listeners of every type found on the page")
 	flag.StringVarP(&conf.ReportFile, "report-file", "R", "", "The file to write the HTML report to")
 
 	ls := flag.BoolP("list-tasks", "l", false, "List tasks and exit")
-	insecure := flag.BoolP("insecure", "k", false, "Ignore certificate errors")
+	flag.BoolVarP(&conf.Insecure, "insecure", "k", false, "Ignore certificate errors")
+	flag.StringVarP(&conf.Proxy, "proxy", "", "", "A proxy to send all traffic through, such as http://127.0.0.1:8080 or socks5://127.0.0.1:1080")
+	flag.StringVarP(&conf.ProxyList, "proxy-list", "", "", "A file of proxies, one per line, which are shared between the workers. Each worker runs its own browser")
+	flag.StringVarP(&conf.ProxyBypass, "proxy-bypass", "", "", "A semicolon separated list of hosts to connect to directly rather than through the proxy, such as '*.example.com;<-loopback>'")
 	visible := flag.BoolP("visible", "", false, "Show the Chrome window rather than running in headless mode")
+	flag.StringVarP(&conf.Remote, "remote", "", "", "Open tabs in an already running Chrome, given by its DevTools WebSocket URL or the http:// address of its remote debugging port, rather than launching a new one")
 
 	noReport := flag.BoolP("no-report", "", false, "Don't write out the HTML report")
 	reportOnly := flag.BoolP("no-scan", "", false, "Only write the HTML report, don't run the scan again")
@@ -129,7 +329,7 @@ func main() {
 	flag.Parse()
 
 	if *ls {
-		listTasks()
+		listTasks(&conf)
 		os.Exit(0)
 	}
 
@@ -153,13 +353,18 @@ func main() {
 
 	if !*reportOnly {
 		// User options controlling chrome
-		certParams := security.SetIgnoreCertificateErrors(*insecure)
+		certParams := security.SetIgnoreCertificateErrors(conf.Insecure)
 		opts := append(chromedp.DefaultExecAllocatorOptions[:], chromedp.Flag("headless", !*visible))
-
-		tasks, err := getTasks(&conf)
+		proxies, err := loadProxies(&conf)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if conf.Proxy != "" {
+			opts = append(opts, chromedp.ProxyServer(conf.Proxy))
+		}
+		if conf.ProxyBypass != "" {
+			opts = append(opts, chromedp.Flag("proxy-bypass-list", conf.ProxyBypass))
+		}
 
 		// Channels to communicate with workers
 		// urlsChan is used to send URLs to workers to load and scan
@@ -176,17 +381,74 @@ func main() {
 		workerWg := &sync.WaitGroup{}
 		workerWg.Add(conf.NumThreads)
 
+		var macros []*Macro
+		if conf.MacrosFile != "" {
+			if macros, err = loadMacros(conf.MacrosFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		auth, err := loadAuth(&conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Module options are checked here, as getTasks is only called once Chrome has launched
+		if _, err := regexp.Compile(conf.ExerciseSkip); err != nil {
+			log.Fatalf("Invalid --exercise-skip pattern: %v\n", err)
+		}
+
+		// Report errors to stderr. This is started before the workers are created, as they can
+		// report errors while logging in
+		go func() {
+			l := log.New(os.Stderr, "ERROR: ", 0)
+			for {
+				err := <-errorChan
+				l.Println(err)
+			}
+		}()
+
 		// Create the workers
 		workers := make([]*Worker, conf.NumThreads)
-		partentCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
+		var partentCtx context.Context
+		var cancel context.CancelFunc
+		if conf.Remote != "" {
+			if *visible || conf.Proxy != "" || conf.ProxyList != "" || conf.ProxyBypass != "" {
+				log.Fatal("The --visible and proxy options can't be used with --remote, as the browser is already running")
+			}
+			wsURL, err := remoteURL(&conf)
+			if err != nil {
+				log.Fatal(err)
+			}
+			partentCtx, cancel = chromedp.NewRemoteAllocator(context.Background(), wsURL)
+		} else {
+			partentCtx, cancel = chromedp.NewExecAllocator(context.Background(), opts...)
+		}
 		defer cancel()
 		for i := range workers {
-			childCtx, _ := chromedp.NewContext(partentCtx)
+			// With a proxy list, each worker gets its own browser so that it can use its own
+			// proxy. Browsers are only launched once a context is run, so the shared one above
+			// is never started.
+			allocCtx := partentCtx
+			if conf.ProxyList != "" {
+				var cancelAlloc context.CancelFunc
+				allocCtx, cancelAlloc = chromedp.NewExecAllocator(context.Background(), append(opts, chromedp.ProxyServer(proxies[i%len(proxies)]))...)
+				defer cancelAlloc()
+			}
+
+			childCtx, _ := chromedp.NewContext(allocCtx)
 			if err := chromedp.Run(childCtx, certParams); err != nil {
 				log.Fatalf("Failed to launch chrome insance: %v\n", err)
 			}
 			defer cancel()
 
+			// Each worker gets its own set of tasks, so that tasks can keep state about the
+			// page currently being loaded
+			tasks, err := getTasks(&conf)
+			if err != nil {
+				log.Fatal(err)
+			}
+
 			w := &Worker{
 				ctx:    &childCtx,
 				id:     i,
@@ -194,6 +456,11 @@ func main() {
 				wg:     workerWg,
 				urlsWg: urlsWg,
 				config: &conf,
+				macros: macros,
+				auth:   auth,
+			}
+			if err := w.authenticate(errorChan); err != nil {
+				log.Fatalf("Worker %d: %v\n", i, err)
 			}
 			workers[i] = w
 			go w.Work(urlsChan, errorChan, failureChan)
@@ -215,14 +482,9 @@ func main() {
 
 		// Read targets line by line and dispatch to workers
 		tfile.Seek(0, io.SeekStart)
-		re := regexp.MustCompile("^https?://")
 		go func() {
 			for tscanner.Scan() {
-				u := tscanner.Text()
-				if !re.MatchString(u) {
-					u = "https://" + u
-				}
-				urlsChan <- u
+				urlsChan <- targetURL(tscanner.Text())
 			}
 
 			if err = tscanner.Err(); err != nil {
@@ -247,18 +509,12 @@ func main() {
 			}
 		}()
 
-		// Report errors to stderr
-		go func() {
-			l := log.New(os.Stderr, "ERROR: ", 0)
-			for {
-				err := <-errorChan
-				l.Println(err)
-			}
-		}()
-
 		urlsWg.Wait()
 		close(urlsChan)
 		workerWg.Wait()
+		if conf.Remote != "" {
+			closeTabs(workers)
+		}
 	}
 
 	if !*noReport {
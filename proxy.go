@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"strings"
+
+	"github.com/danielthatcher/spydom/config"
+)
+
+// loadProxies returns the proxies given with --proxy or --proxy-list. With a list, workers are
+// assigned the proxies in turn, each with its own browser.
+func loadProxies(c *config.Config) ([]string, error) {
+	if c.Proxy != "" && c.ProxyList != "" {
+		return nil, errors.New("only one of --proxy and --proxy-list can be given")
+	}
+	if c.Proxy != "" {
+		if err := checkProxy(c.Proxy); err != nil {
+			return nil, err
+		}
+		return []string{c.Proxy}, nil
+	}
+	if c.ProxyList == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(c.ProxyList)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open proxy list: %v", err)
+	}
+	defer f.Close()
+
+	var ret []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p := strings.TrimSpace(scanner.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		if err := checkProxy(p); err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read proxy list: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("the proxy list doesn't contain any proxies")
+	}
+	return ret, nil
+}
+
+// checkProxy checks that a proxy is given as a URL with a scheme Chrome supports. Chrome ignores
+// any credentials in --proxy-server, so proxies which need them are rejected rather than failing
+// silently.
+func checkProxy(p string) error {
+	u, err := neturl.Parse(p)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid proxy %q, proxies should be given as scheme://host:port", p)
+	}
+	if u.User != nil {
+		return fmt.Errorf("the proxy at %s has credentials, which aren't supported by Chrome's --proxy-server. Use a proxy which doesn't need authentication, or allow the scanner's IP address instead", u.Host)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks4", "socks5":
+		return nil
+	}
+	return fmt.Errorf("unsupported scheme for proxy %q, use http, https, socks4 or socks5", p)
+}
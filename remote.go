@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// remoteURL returns the DevTools WebSocket URL of the browser given with --remote. The address
+// of the remote debugging port, such as http://127.0.0.1:9222, can also be given, in which case
+// the WebSocket URL is looked up from it.
+func remoteURL(c *config.Config) (string, error) {
+	u, err := neturl.Parse(c.Remote)
+	if err != nil {
+		return "", fmt.Errorf("invalid remote URL: %v", err)
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		return c.Remote, nil
+	case "http", "https":
+	default:
+		return "", errors.New("the remote URL should be a ws:// DevTools URL, or the http:// address of the remote debugging port")
+	}
+
+	client := &http.Client{Timeout: c.Timeout}
+	resp, err := client.Get(strings.TrimSuffix(c.Remote, "/") + "/json/version")
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to remote browser: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var version struct {
+		WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return "", fmt.Errorf("failed to read remote browser version: %v", err)
+	}
+	if version.WebSocketDebuggerURL == "" {
+		return "", errors.New("the remote browser didn't give a DevTools URL")
+	}
+	return version.WebSocketDebuggerURL, nil
+}
+
+// closeTabs closes the tabs opened by the workers. This is only needed for remote browsers, as
+// launched browsers are closed along with their tabs.
+func closeTabs(workers []*Worker) {
+	for _, w := range workers {
+		chromedp.Cancel(*w.ctx)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
@@ -12,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/danielthatcher/spydom/config"
+	"github.com/danielthatcher/spydom/tasks"
 	"github.com/gobuffalo/packr"
 )
 
@@ -40,31 +43,96 @@ func report(conf *config.Config) error {
 			encoded := base64.StdEncoding.EncodeToString(b)
 			return template.URL("data:image/png;base64," + encoded)
 		},
-		"embedBeautified": func(dir string) template.HTML {
-			// Glob for all beautified lsiteners
-			g := path.Join(dir, "*.beautified")
-			matches, err := filepath.Glob(g)
+		"glob": func(dir string, pattern string) []string {
+			matches, err := filepath.Glob(path.Join(dir, pattern))
 			if err != nil {
-				log.Printf("Error finding beatufied JS files in %s: %v\n", dir, err)
+				log.Printf("Error globbing for %s in %s: %v\n", pattern, dir, err)
 			}
+			return matches
+		},
+		"contains": func(s interface{}, substr string) bool {
+			return strings.Contains(fmt.Sprint(s), substr)
+		},
+		"canaryPrefix": func() string {
+			return tasks.CanaryPrefix
+		},
+		"base": func(p string) string {
+			return filepath.Base(p)
+		},
+		"readJSON": func(p string) interface{} {
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				log.Printf("Failed to read file '%s' while generating template: %v\n", p, err)
+				return nil
+			}
+			var ret interface{}
+			if err := json.Unmarshal(b, &ret); err != nil {
+				log.Printf("Failed to parse file '%s' while generating template: %v\n", p, err)
+				return nil
+			}
+			return ret
+		},
+		"readJSONL": func(p string) []map[string]interface{} {
+			f, err := os.Open(p)
+			if err != nil {
+				log.Printf("Failed to open file '%s' while generating template: %v\n", p, err)
+				return nil
+			}
+			defer f.Close()
 
-			// Construct HTML output
-			var buf string
-			for _, m := range matches {
-				name := strings.Replace(filepath.Base(m), ".beautified", "", 1)
-				buf += "// " + name + "\n"
-				contents, err := ioutil.ReadFile(m)
-				if err != nil {
-					log.Printf("Failed to read message listener file %s: %v\n", m, err)
+			var ret []map[string]interface{}
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(nil, 64*1024*1024)
+			for scanner.Scan() {
+				var m map[string]interface{}
+				if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+					log.Printf("Failed to parse line of '%s' while generating template: %v\n", p, err)
+					continue
 				}
-				buf += string(contents)
-				buf += "\n"
+				ret = append(ret, m)
 			}
-
-			if buf == "" {
-				return template.HTML("None")
+			return ret
+		},
+		"toJSON": func(v interface{}) string {
+			b, err := json.Marshal(v)
+			if err != nil {
+				log.Printf("Failed to encode value while generating template: %v\n", err)
 			}
-			return template.HTML(buf)
+			return string(b)
+		},
+		"countWhere": func(items []map[string]interface{}, key string, value string) int {
+			n := 0
+			for _, m := range items {
+				if fmt.Sprint(m[key]) == value {
+					n++
+				}
+			}
+			return n
+		},
+		"dict": func(kv ...interface{}) map[string]interface{} {
+			m := make(map[string]interface{})
+			for i := 0; i+1 < len(kv); i += 2 {
+				m[kv[i].(string)] = kv[i+1]
+			}
+			return m
+		},
+		"scriptFile": func(dir string, scriptID string) string {
+			// Find the script saved by the scripts module
+			b, err := ioutil.ReadFile(path.Join(dir, "scripts", "manifest.json"))
+			if err != nil {
+				return ""
+			}
+			var scripts []tasks.ScriptInfo
+			if err := json.Unmarshal(b, &scripts); err != nil {
+				log.Printf("Failed to parse scripts manifest in %s: %v\n", dir, err)
+				return ""
+			}
+			for _, s := range scripts {
+				if s.ScriptID == scriptID {
+					return path.Join(dir, s.File)
+				}
+			}
+			return ""
 		},
 	}).Parse(box.String("index.html"))
 	if err != nil {
@@ -78,6 +146,12 @@ func report(conf *config.Config) error {
 		log.Fatalf("Failed to open URLs file when generating report: %v\n", err)
 	}
 
+	// ReportURL is a requested URL, along with the redirects which led from it to the final URL
+	type ReportURL struct {
+		URL   string
+		Chain *tasks.RedirectChain
+	}
+
 	// ReportFrame is passed to the template to consolidate requested URLs which lead to the
 	// same final URL.
 	type ReportFrame struct {
@@ -85,7 +159,7 @@ func report(conf *config.Config) error {
 		Dir string
 
 		// Urls is a slice of URLs which all lead to navigation to same final URL
-		Urls []string
+		Urls []ReportURL
 	}
 
 	// Dirs holds all the directories for the output
@@ -103,12 +177,22 @@ func report(conf *config.Config) error {
 			log.Printf("failed to read %s: %v\n", urlfile, err)
 		}
 
+		// The redirect chain is only saved by newer versions of the location module
+		req := ReportURL{URL: reqUrl}
+		if b, err := ioutil.ReadFile(path.Join(abs, "redirects.json")); err == nil {
+			req.Chain = &tasks.RedirectChain{}
+			if err := json.Unmarshal(b, req.Chain); err != nil {
+				log.Printf("failed to parse redirect chain for %s: %v\n", reqUrl, err)
+				req.Chain = nil
+			}
+		}
+
 		u := strings.TrimSpace(string(b))
 		if _, exists := frames[u]; !exists {
-			frames[u] = ReportFrame{abs, []string{reqUrl}}
+			frames[u] = ReportFrame{abs, []ReportURL{req}}
 		} else {
 			f := frames[u]
-			f.Urls = append(f.Urls, reqUrl)
+			f.Urls = append(f.Urls, req)
 			frames[u] = f
 		}
 	}
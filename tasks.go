@@ -13,7 +13,8 @@ import (
 // Task represents a task that should be performed on all pages
 type Task interface {
 	// The Priority of a task determines when it will be run.
-	// Tasks with priority 1 do passive checks that don't modify the DOM, and are run first.
+	// Tasks with priority 0 are run first, and may interact with the page to expose state for later tasks to see.
+	// Tasks with priority 1 do passive checks that don't modify the DOM.
 	// Tasks with priority 2 do light active checks that make largely inconsequential modifications to the DOM.
 	// Tasks with priority 3 may make significant changes to the DOM, that might interfere with other tasks.
 	Priority() uint8
@@ -31,23 +32,76 @@ type Task interface {
 	Init(c *config.Config) error
 }
 
-func allTasks() []Task {
-	return []Task{
+// LifecycleTask is an optional interface for tasks which need to observe the whole life of a
+// page rather than just the loaded page, such as those which install CDP event listeners,
+// scripts to evaluate on new documents, or network interception. Tasks which implement it still
+// have Run called as normal.
+type LifecycleTask interface {
+	// Preload is called before the worker navigates to the URL. The context passed to it is
+	// cancelled once Teardown has been called, which also removes any listeners added with it.
+	Preload(ctx context.Context, url string, absDir string, relDir string) error
+
+	// Teardown is called after all tasks have been run on the page, or after the page has
+	// failed to load, and should undo anything done by Preload and write out any results.
+	Teardown(ctx context.Context, url string, absDir string, relDir string) error
+}
+
+// ActiveTask is an optional interface for tasks which actively attack the page, for example by
+// fuzzing it. Active tasks are only run when the --active flag is given, or when they're
+// explicitly enabled with -e.
+type ActiveTask interface {
+	Active() bool
+}
+
+// FrameTask is an optional interface for tasks which can also be run in each of the page's
+// frames. When the --frames flag is given, these tasks are run in every frame after the main
+// frame, with the output for each frame stored in its own subdirectory.
+type FrameTask interface {
+	PerFrame() bool
+}
+
+func allTasks(c *config.Config) []Task {
+	// Each event type given with --listeners becomes its own task, with "all" extracting
+	// listeners of every type found on the page. As "all" writes to the same directories as the
+	// other tasks would, it replaces them rather than being added to them.
+	var listeners []Task
+	for _, e := range c.ListenerEvents {
+		if e == "all" {
+			listeners = []Task{&tasks.EventListener{}}
+			break
+		}
+		listeners = append(listeners, &tasks.EventListener{Event: e})
+	}
+
+	return append(listeners,
 		&tasks.Screenshot{},
-		&tasks.EventListener{Event: "message"},
-		&tasks.EventListener{Event: "hashchange"},
 		&tasks.JSRunner{},
 		&tasks.Location{},
 		&tasks.LocalStorage{},
+		&tasks.IndexedDB{},
 		&tasks.OuterHTML{},
 		&tasks.Title{},
 		&tasks.HeapSnapshot{},
-	}
-
+		&tasks.WebSocket{},
+		&tasks.Network{},
+		&tasks.Headers{},
+		&tasks.Cookies{},
+		&tasks.Scripts{},
+		&tasks.SourceMaps{},
+		&tasks.Console{},
+		&tasks.TLS{},
+		&tasks.Frames{},
+		&tasks.Workers{},
+		&tasks.PostMessage{},
+		&tasks.DOMXSS{},
+		&tasks.HashFuzz{},
+		&tasks.PrototypePollution{},
+		&tasks.Exercise{},
+	)
 }
 
-func listTasks() {
-	tasks := allTasks()
+func listTasks(c *config.Config) {
+	tasks := allTasks(c)
 
 	w := new(tabwriter.Writer)
 	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
@@ -59,9 +113,16 @@ func listTasks() {
 }
 
 func getTasks(c *config.Config) ([]Task, error) {
-	tasks := allTasks()
+	tasks := allTasks(c)
+	slugs := make(map[string]bool)
 	for i := range tasks {
 		tasks[i].Init(c)
+
+		// Event types given with --listeners could otherwise share a name with a module
+		if slugs[tasks[i].Slug()] {
+			return nil, fmt.Errorf("more than one module is named %s", tasks[i].Slug())
+		}
+		slugs[tasks[i].Slug()] = true
 	}
 
 	if c.Enabled != nil {
@@ -75,22 +136,28 @@ func getTasks(c *config.Config) ([]Task, error) {
 			}
 		}
 		tasks = newTasks
+	} else if !c.Active {
+		newTasks := []Task{}
+		for _, t := range tasks {
+			if a, ok := t.(ActiveTask); !ok || !a.Active() {
+				newTasks = append(newTasks, t)
+			}
+		}
+		tasks = newTasks
 	}
 
-	// Disable the jsrunner module if --js or --js-file are not specified
+	// Disable the jsrunner module if --js or --js-file are not specified. This is kept out of
+	// c.Disabled as getTasks is called once for each worker.
+	disabled := c.Disabled
 	if c.JS == "" && c.JSFile == "" {
-		if c.Disabled == nil {
-			c.Disabled = []string{"jsrunner"}
-		} else {
-			c.Disabled = append(c.Disabled, "jsrunner")
-		}
+		disabled = append(disabled[:len(disabled):len(disabled)], "jsrunner")
 	}
 
-	if c.Disabled != nil {
+	if disabled != nil {
 		newTasks := []Task{}
 		for _, t := range tasks {
 			enabled := true
-			for _, slug := range c.Disabled {
+			for _, slug := range disabled {
 				if t.Slug() == slug {
 					enabled = false
 					break
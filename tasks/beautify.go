@@ -0,0 +1,21 @@
+package tasks
+
+import (
+	"io/ioutil"
+
+	"github.com/ditashi/jsbeautifier-go/jsbeautifier"
+)
+
+// writeBeautified writes the given JavaScript to p, and a beautified version of it to the same
+// path with a .beautified extension.
+func writeBeautified(p string, js string) error {
+	formatted, _ := jsbeautifier.Beautify(&js, jsbeautifier.DefaultOptions())
+
+	// Write original to file
+	if err := ioutil.WriteFile(p, []byte(js), 0644); err != nil {
+		return err
+	}
+
+	// Write beautified version to file
+	return ioutil.WriteFile(p+".beautified", []byte(formatted), 0644)
+}
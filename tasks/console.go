@@ -0,0 +1,174 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	cdplog "github.com/chromedp/cdproto/log"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// ConsoleMessage is a single line of the console log
+type ConsoleMessage struct {
+	Time         time.Time `json:"time"`
+	Source       string    `json:"source"`
+	Level        string    `json:"level"`
+	Text         string    `json:"text"`
+	URL          string    `json:"url,omitempty"`
+	LineNumber   int64     `json:"lineNumber,omitempty"`
+	ColumnNumber int64     `json:"columnNumber,omitempty"`
+	Stack        string    `json:"stack,omitempty"`
+}
+
+// Console message sources
+const (
+	ConsoleAPI       = "console"
+	ConsoleException = "exception"
+	ConsoleLog       = "log"
+)
+
+// The Console task logs console messages, uncaught exceptions and browser log entries from the
+// moment navigation starts
+type Console struct {
+	mu   sync.Mutex
+	file string
+}
+
+func (t *Console) Priority() uint8 {
+	return 1
+}
+
+func (t *Console) Slug() string {
+	return "console"
+}
+
+func (t *Console) Description() string {
+	return "Log console messages, uncaught exceptions and browser log entries"
+}
+
+func (t *Console) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *Console) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.file = path.Join(absDir, "console.jsonl")
+	os.Remove(t.file)
+	t.mu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		switch ev := ev.(type) {
+		case *runtime.EventConsoleAPICalled:
+			args := make([]string, len(ev.Args))
+			for i, a := range ev.Args {
+				args[i] = remoteObjectString(a)
+			}
+			m := ConsoleMessage{
+				Source: ConsoleAPI,
+				Level:  consoleLevel(ev.Type),
+				Text:   strings.Join(args, " "),
+				Stack:  formatStack(ev.StackTrace),
+			}
+			if ev.StackTrace != nil && len(ev.StackTrace.CallFrames) > 0 {
+				f := ev.StackTrace.CallFrames[0]
+				m.URL, m.LineNumber, m.ColumnNumber = f.URL, f.LineNumber, f.ColumnNumber
+			}
+			t.log(m)
+		case *runtime.EventExceptionThrown:
+			d := ev.ExceptionDetails
+			text := d.Text
+			if d.Exception != nil && d.Exception.Description != "" {
+				text = d.Exception.Description
+			}
+			t.log(ConsoleMessage{
+				Source:       ConsoleException,
+				Level:        "error",
+				Text:         text,
+				URL:          d.URL,
+				LineNumber:   d.LineNumber,
+				ColumnNumber: d.ColumnNumber,
+				Stack:        formatStack(d.StackTrace),
+			})
+		case *cdplog.EventEntryAdded:
+			e := ev.Entry
+			t.log(ConsoleMessage{
+				Source:     ConsoleLog,
+				Level:      e.Level.String(),
+				Text:       e.Text,
+				URL:        e.URL,
+				LineNumber: e.LineNumber,
+				Stack:      formatStack(e.StackTrace),
+			})
+		}
+	})
+
+	// The Runtime and Log domains are already enabled by chromedp
+	return nil
+}
+
+// consoleLevel converts the type of a console API call to a log level
+func consoleLevel(t runtime.APIType) string {
+	switch t {
+	case runtime.APITypeError, runtime.APITypeAssert:
+		return "error"
+	case runtime.APITypeWarning:
+		return "warning"
+	case runtime.APITypeDebug:
+		return "verbose"
+	}
+	return "info"
+}
+
+// remoteObjectString converts an argument to a console API call to a string, in a similar way to
+// the DevTools console
+func remoteObjectString(o *runtime.RemoteObject) string {
+	if len(o.Value) > 0 {
+		var s string
+		if err := json.Unmarshal(o.Value, &s); err == nil {
+			return s
+		}
+		return string(o.Value)
+	}
+	if o.UnserializableValue != "" {
+		return o.UnserializableValue.String()
+	}
+	if o.Description != "" {
+		return o.Description
+	}
+	return o.Type.String()
+}
+
+// log appends a message to the console log
+func (t *Console) log(m ConsoleMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m.Time = time.Now()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(t.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(b, '\n'))
+}
+
+func (t *Console) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	// Messages are logged as they arrive, so there's nothing left to do once the page has loaded
+	return nil
+}
+
+func (t *Console) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	return nil
+}
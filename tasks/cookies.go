@@ -0,0 +1,154 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+	"github.com/mailru/easyjson/jlexer"
+)
+
+// Cookie holds the attributes of a cookie set for the page. This is decoded directly from
+// Chrome's response, rather than through network.Cookie, so that attributes added in newer
+// versions of Chrome, such as the partition key, are kept.
+type Cookie struct {
+	Name               string          `json:"name"`
+	Value              string          `json:"value"`
+	Domain             string          `json:"domain"`
+	Path               string          `json:"path"`
+	Expires            float64         `json:"expires"`
+	ExpiresTime        string          `json:"expiresTime,omitempty"`
+	Size               int64           `json:"size"`
+	HTTPOnly           bool            `json:"httpOnly"`
+	Secure             bool            `json:"secure"`
+	Session            bool            `json:"session"`
+	SameSite           string          `json:"sameSite,omitempty"`
+	Priority           string          `json:"priority,omitempty"`
+	PartitionKey       json.RawMessage `json:"partitionKey,omitempty"`
+	PartitionKeyOpaque bool            `json:"partitionKeyOpaque,omitempty"`
+	Issues             []string        `json:"issues,omitempty"`
+}
+
+// getCookiesResult is the result of Network.getCookies
+type getCookiesResult struct {
+	Cookies []*Cookie `json:"cookies"`
+}
+
+func (r *getCookiesResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	if err := json.Unmarshal(l.Raw(), r); err != nil {
+		l.AddError(err)
+	}
+}
+
+// sessionCookieWord matches the words in the names of cookies which look like they hold a
+// session, such as PHPSESSID, connect.sid and auth_token
+var sessionCookieWord = regexp.MustCompile(`(?i)^(\w*sess(ion)?(id)?|sid|auth|token|jwt|login|remember)$`)
+
+// csrfCookieWord matches the words in the names of double-submit CSRF cookies, such as
+// XSRF-TOKEN, which have to be readable by JavaScript
+var csrfCookieWord = regexp.MustCompile(`(?i)^(csrf|xsrf)$`)
+
+var camelCase = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+
+var cookieNameSeparator = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// isSessionCookie reports whether a cookie looks like it holds a session, going by the words
+// in its name. Names are split into words at separators and camel case, so that names such as
+// author_pref aren't matched.
+func isSessionCookie(name string) bool {
+	session := false
+	for _, w := range cookieNameSeparator.Split(camelCase.ReplaceAllString(name, "${1}_${2}"), -1) {
+		if csrfCookieWord.MatchString(w) {
+			return false
+		}
+		if sessionCookieWord.MatchString(w) {
+			session = true
+		}
+	}
+	return session
+}
+
+// The Cookies task saves the cookies set for the page and flags any with weak attributes
+type Cookies struct {
+	documentResponses
+}
+
+func (t *Cookies) Priority() uint8 {
+	return 1
+}
+
+func (t *Cookies) Slug() string {
+	return "cookies"
+}
+
+func (t *Cookies) Description() string {
+	return "Save the cookies set for the page, and flag session cookies missing the Secure or HttpOnly attributes"
+}
+
+func (t *Cookies) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *Cookies) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	return t.listenDocuments(ctx)
+}
+
+func (t *Cookies) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	// The cookies are those sent to the target, rather than to wherever earlier tasks have
+	// since navigated the page
+	var res getCookiesResult
+	tasks := chromedp.Tasks{chromedp.ActionFunc(func(c context.Context) error {
+		var finalURL string
+		if doc := t.mainDocument(); doc != nil {
+			finalURL = doc.Response.URL
+		} else if err := chromedp.Location(&finalURL).Do(c); err != nil {
+			return err
+		}
+		return cdp.Execute(c, network.CommandGetCookies, network.GetCookies().WithUrls([]string{finalURL}), &res)
+	})}
+	if err := chromedp.Run(ctx, tasks); err != nil {
+		return fmt.Errorf("failed to retrieve cookies: %v", err)
+	}
+
+	for _, c := range res.Cookies {
+		if !c.Session {
+			c.ExpiresTime = time.Unix(int64(c.Expires), 0).UTC().Format(time.RFC3339)
+		}
+		if isSessionCookie(c.Name) {
+			if !c.Secure {
+				c.Issues = append(c.Issues, "Session cookie is missing the Secure attribute")
+			}
+			if !c.HTTPOnly {
+				c.Issues = append(c.Issues, "Session cookie is missing the HttpOnly attribute")
+			}
+		}
+		if c.SameSite == "None" && !c.Secure {
+			c.Issues = append(c.Issues, "SameSite=None is set without the Secure attribute")
+		}
+	}
+	if res.Cookies == nil {
+		res.Cookies = []*Cookie{}
+	}
+
+	b, err := json.MarshalIndent(res.Cookies, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cookies: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "cookies.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write cookies to file: %v", err)
+	}
+
+	return nil
+}
+
+func (t *Cookies) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+)
+
+// documentResponses records the responses to document requests made while a page loads, so
+// that the response for the page's main frame can be found afterwards. It is intended to be
+// embedded in tasks implementing the LifecycleTask interface.
+type documentResponses struct {
+	docMu     sync.Mutex
+	frameID   cdp.FrameID
+	main      *network.EventResponseReceived
+	loaded    bool
+	responses []*network.EventResponseReceived
+}
+
+// listenDocuments starts recording document responses, discarding any from previous pages
+func (d *documentResponses) listenDocuments(ctx context.Context) error {
+	// The main frame keeps its ID when it navigates
+	var tree *page.FrameTree
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		var err error
+		tree, err = page.GetFrameTree().Do(c)
+		return err
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to get frame tree: %v", err)
+	}
+
+	d.docMu.Lock()
+	d.frameID = tree.Frame.ID
+	d.main = nil
+	d.loaded = false
+	d.responses = nil
+	d.docMu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		d.docMu.Lock()
+		defer d.docMu.Unlock()
+		switch ev := ev.(type) {
+		case *network.EventResponseReceived:
+			if ev.Type != network.ResourceTypeDocument {
+				return
+			}
+			d.responses = append(d.responses, ev)
+			if ev.FrameID == d.frameID && !d.loaded {
+				d.main = ev
+			}
+		case *page.EventLoadEventFired:
+			// Later tasks may navigate or reload the page, such as with probes in the URL, so
+			// the main document is the one the target loaded
+			if d.main != nil {
+				d.loaded = true
+			}
+		}
+	})
+
+	if err := chromedp.Run(ctx, network.Enable()); err != nil {
+		return fmt.Errorf("failed to enable network events: %v", err)
+	}
+	return nil
+}
+
+// mainDocument returns the response received for the page's main frame when the target was
+// loaded, or nil if there wasn't one
+func (d *documentResponses) mainDocument() *network.EventResponseReceived {
+	d.docMu.Lock()
+	defer d.docMu.Unlock()
+	return d.main
+}
+
+// isDocument returns whether u, ignoring any fragment, is the URL of a document received for
+// the page or any of its frames
+func (d *documentResponses) isDocument(u string) bool {
+	u = strings.SplitN(u, "#", 2)[0]
+	d.docMu.Lock()
+	defer d.docMu.Unlock()
+	for _, r := range d.responses {
+		if r.Response.URL == u {
+			return true
+		}
+	}
+	return false
+}
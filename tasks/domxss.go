@@ -0,0 +1,194 @@
+package tasks
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// TaintFinding records a canary injected into a source reaching a sink
+type TaintFinding struct {
+	Source string     `json:"source"`
+	Canary string     `json:"canary"`
+	Hits   []*SinkHit `json:"hits"`
+}
+
+// TaintResult is written by the DOMXSS task
+type TaintResult struct {
+	Sources  []string        `json:"sources"`
+	Findings []*TaintFinding `json:"findings"`
+}
+
+// The DOMXSS task injects canaries into the sources an attacker controls, and records any which
+// reach a dangerous sink
+type DOMXSS struct {
+	sinkRecorder
+}
+
+func (t *DOMXSS) Priority() uint8 {
+	return 3
+}
+
+func (t *DOMXSS) Slug() string {
+	return "domxss"
+}
+
+func (t *DOMXSS) Description() string {
+	return "Trace canaries from the URL, referrer, window.name and postMessage data to dangerous sinks"
+}
+
+func (t *DOMXSS) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *DOMXSS) Active() bool {
+	return true
+}
+
+func (t *DOMXSS) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	if err := t.listenSinks(ctx); err != nil {
+		return fmt.Errorf("failed to install sink hooks: %v", err)
+	}
+	return nil
+}
+
+func (t *DOMXSS) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	var loc string
+	if err := chromedp.Run(ctx, chromedp.Location(&loc)); err != nil {
+		return fmt.Errorf("failed to retrieve page location: %v", err)
+	}
+	u, err := neturl.Parse(loc)
+	if err != nil {
+		return err
+	}
+
+	res := &TaintResult{Sources: []string{}, Findings: []*TaintFinding{}}
+	canaries := make(map[string]string)
+
+	// Every query parameter, along with a new one, gets its own canary in a single load
+	q := u.Query()
+	params := []string{"spydom"}
+	for k := range q {
+		params = append(params, k)
+	}
+	for _, k := range params {
+		c := newCanary()
+		q.Set(k, c)
+		canaries[c] = "query:" + k
+	}
+	qu := *u
+	qu.RawQuery = q.Encode()
+	if err := reload(ctx, qu.String(), ""); err != nil {
+		return err
+	}
+	res.Sources = append(res.Sources, "query")
+
+	c := newCanary()
+	canaries[c] = "hash"
+	hu := *u
+	hu.Fragment = c
+	if err := reload(ctx, hu.String(), ""); err != nil {
+		return err
+	}
+	res.Sources = append(res.Sources, "hash")
+
+	// The default referrer policy strips cross-origin referrers down to their origin, so the
+	// canary goes in the hostname
+	c = newCanary()
+	canaries[c] = "referrer"
+	if err := reload(ctx, loc, fmt.Sprintf("https://%s.example.com/", c)); err != nil {
+		return err
+	}
+	res.Sources = append(res.Sources, "referrer")
+
+	// Browsers clear window.name on cross-site navigations, so set it before the page's scripts
+	// run instead
+	c = newCanary()
+	canaries[c] = "window.name"
+	if err := t.loadWithName(ctx, loc, c); err != nil {
+		return err
+	}
+	res.Sources = append(res.Sources, "window.name")
+
+	// Messages are sent last, so that the page is left loaded from its original URL
+	if err := reload(ctx, loc, ""); err != nil {
+		return err
+	}
+	for _, p := range []func(string) interface{}{
+		func(c string) interface{} { return c },
+		func(c string) interface{} {
+			m := make(map[string]string, len(postMessageKeys))
+			for _, k := range postMessageKeys {
+				m[k] = c
+			}
+			return m
+		},
+	} {
+		c := newCanary()
+		canaries[c] = "postMessage"
+		b, err := json.Marshal(p(c))
+		if err != nil {
+			return fmt.Errorf("failed to encode payload: %v", err)
+		}
+		var ignored []byte
+		js := fmt.Sprintf(postMessageJS, base64.StdEncoding.EncodeToString(b), "self")
+		if err := chromedp.Run(ctx, chromedp.Evaluate(js, &ignored)); err != nil {
+			return fmt.Errorf("failed to send message: %v", err)
+		}
+	}
+	time.Sleep(fuzzWait)
+	res.Sources = append(res.Sources, "postMessage")
+
+	for c, source := range canaries {
+		if hits := t.sinkHits(c); len(hits) > 0 {
+			res.Findings = append(res.Findings, &TaintFinding{Source: source, Canary: c, Hits: hits})
+		}
+	}
+	sort.Slice(res.Findings, func(i, j int) bool {
+		if res.Findings[i].Source != res.Findings[j].Source {
+			return res.Findings[i].Source < res.Findings[j].Source
+		}
+		return res.Findings[i].Canary < res.Findings[j].Canary
+	})
+	if err := restoreLocation(ctx, loc); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode DOM XSS results: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "domxss.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write DOM XSS results to file: %v", err)
+	}
+	return nil
+}
+
+// loadWithName loads u with window.name set to name before any of the page's scripts run
+func (t *DOMXSS) loadWithName(ctx context.Context, u string, name string) error {
+	var id page.ScriptIdentifier
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		var err error
+		id, err = page.AddScriptToEvaluateOnNewDocument(fmt.Sprintf("window.name = %q;", name)).Do(c)
+		return err
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to set window.name: %v", err)
+	}
+	defer chromedp.Run(ctx, page.RemoveScriptToEvaluateOnNewDocument(id))
+	return reload(ctx, u, "")
+}
+
+func (t *DOMXSS) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	return t.removeSinks(ctx)
+}
@@ -2,18 +2,250 @@ package tasks
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/domdebugger"
+	"github.com/chromedp/cdproto/runtime"
 	"github.com/chromedp/chromedp"
 	"github.com/danielthatcher/spydom/config"
-	"github.com/ditashi/jsbeautifier-go/jsbeautifier"
 )
 
-// EventListener extracts the functions listening for message events from the DOM
+// ListenerInfo describes a single event listener found on the page
+type ListenerInfo struct {
+	Type         string `json:"type"`
+	Name         string `json:"name"`
+	Node         string `json:"node"`
+	UseCapture   bool   `json:"useCapture"`
+	Passive      bool   `json:"passive"`
+	Once         bool   `json:"once"`
+	ScriptID     string `json:"scriptId"`
+	URL          string `json:"url"`
+	LineNumber   int64  `json:"lineNumber"`
+	ColumnNumber int64  `json:"columnNumber"`
+	Source       string `json:"-"`
+}
+
+// listenerObjectGroup is the object group used for remote objects created while finding
+// listeners, so that they can be released afterwards
+const listenerObjectGroup = "spydom-listeners"
+
+// listenerNodesJS returns the nodes which have listeners for any of the given types, or for any
+// type at all if types is null. It relies on getEventListeners from the DevTools command line API.
+const listenerNodesJS = `
+	(function(types) {
+		let nodes = [window, document];
+		nodes.push.apply(nodes, document.querySelectorAll("*"));
+		return nodes.filter(function(n) {
+			let l = getEventListeners(n);
+			if (types === null) {
+				return Object.keys(l).length > 0;
+			}
+			return types.some(function(t) { return t in l; });
+		});
+	})(%s)`
+
+// selectorsJS is called on an array of nodes, and returns a CSS selector for each
+const selectorsJS = `
+	function() {
+		return Array.prototype.map.call(this, function(n) {
+			if (n === window) {
+				return "window";
+			}
+			if (n === document) {
+				return "document";
+			}
+			let parts = [];
+			for (let e = n; e && e.nodeType === Node.ELEMENT_NODE; e = e.parentElement) {
+				if (e.id) {
+					parts.unshift("#" + CSS.escape(e.id));
+					break;
+				}
+				let i = 1;
+				for (let s = e.previousElementSibling; s; s = s.previousElementSibling) {
+					if (s.localName === e.localName) {
+						i++;
+					}
+				}
+				parts.unshift(e.localName + ":nth-of-type(" + i + ")");
+			}
+			return parts.join(" > ");
+		});
+	}`
+
+// handlerJS is called on a listener's handler, and returns its name and source
+const handlerJS = `
+	function() {
+		return {name: this.name, source: Function.prototype.toString.call(this)};
+	}`
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9_$.-]`)
+
+// safeFilename replaces the characters of s which aren't safe in filenames, and prefixes names
+// made only of dots so that they can't refer to a directory
+func safeFilename(s string) string {
+	name := unsafeFilename.ReplaceAllString(s, "_")
+	if name != "" && strings.Trim(name, ".") == "" {
+		name = "_" + name
+	}
+	return name
+}
+
+// getListeners finds all event listeners of the given types on the window, document and every
+// element of the page, or all listeners if types is nil. Listeners are given unique names.
+func getListeners(ctx context.Context, types []string) ([]*ListenerInfo, error) {
+	typesJSON, err := json.Marshal(types)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, t := range types {
+		wanted[t] = true
+	}
+
+	var ret []*ListenerInfo
+	err = runInFrame(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		defer runtime.ReleaseObjectGroup(listenerObjectGroup).Do(c)
+
+		p := runtime.Evaluate(fmt.Sprintf(listenerNodesJS, typesJSON)).
+			WithIncludeCommandLineAPI(true).
+			WithObjectGroup(listenerObjectGroup)
+		nodes, exp, err := inFrame(ctx)(p).Do(c)
+		if err != nil {
+			return err
+		}
+		if exp != nil {
+			return exp
+		}
+
+		selectorsObj, exp, err := runtime.CallFunctionOn(selectorsJS).
+			WithObjectID(nodes.ObjectID).
+			WithReturnByValue(true).
+			Do(c)
+		if err != nil {
+			return err
+		}
+		if exp != nil {
+			return exp
+		}
+		var selectors []string
+		if err := json.Unmarshal(selectorsObj.Value, &selectors); err != nil {
+			return fmt.Errorf("failed to decode selectors: %v", err)
+		}
+
+		props, _, _, exp, err := runtime.GetProperties(nodes.ObjectID).WithOwnProperties(true).Do(c)
+		if err != nil {
+			return err
+		}
+		if exp != nil {
+			return exp
+		}
+
+		names := make(map[string]int)
+		for _, p := range props {
+			i, err := strconv.Atoi(p.Name)
+			if err != nil || i >= len(selectors) || p.Value == nil || p.Value.ObjectID == "" {
+				continue
+			}
+
+			listeners, err := domdebugger.GetEventListeners(p.Value.ObjectID).Do(c)
+			if err != nil {
+				return err
+			}
+			for _, l := range listeners {
+				if types != nil && !wanted[l.Type] {
+					continue
+				}
+				info := &ListenerInfo{
+					Type:         l.Type,
+					Node:         selectors[i],
+					UseCapture:   l.UseCapture,
+					Passive:      l.Passive,
+					Once:         l.Once,
+					ScriptID:     l.ScriptID.String(),
+					LineNumber:   l.LineNumber,
+					ColumnNumber: l.ColumnNumber,
+				}
+
+				var handler struct {
+					Name   string `json:"name"`
+					Source string `json:"source"`
+				}
+				if l.Handler != nil && l.Handler.ObjectID != "" {
+					res, exp, err := runtime.CallFunctionOn(handlerJS).
+						WithObjectID(l.Handler.ObjectID).
+						WithReturnByValue(true).
+						Do(c)
+					if err == nil && exp == nil {
+						json.Unmarshal(res.Value, &handler)
+					}
+				}
+				info.Source = handler.Source
+
+				// Give each listener a unique name that can be used as a filename. Function
+				// names can't contain hyphens, so the suffix can't clash with another name.
+				name := safeFilename(handler.Name)
+				if name == "" {
+					name = "unnamed"
+				}
+				names[name]++
+				if names[name] > 1 {
+					name = fmt.Sprintf("%s-%d", name, names[name]-1)
+				}
+				info.Name = name
+
+				ret = append(ret, info)
+			}
+		}
+		return nil
+	}))
+	return ret, err
+}
+
+// scriptURLs records the URL of each script parsed by the page, so that listeners can be
+// attributed to the script they were defined in. It is intended to be embedded in tasks
+// implementing the LifecycleTask interface.
+type scriptURLs struct {
+	urlsMu sync.Mutex
+	urls   map[string]string
+}
+
+// listenScripts starts recording script URLs, discarding any from previous pages
+func (s *scriptURLs) listenScripts(ctx context.Context) error {
+	s.urlsMu.Lock()
+	s.urls = make(map[string]string)
+	s.urlsMu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		if ev, ok := ev.(*debugger.EventScriptParsed); ok {
+			s.urlsMu.Lock()
+			s.urls[ev.ScriptID.String()] = ev.URL
+			s.urlsMu.Unlock()
+		}
+	})
+	return enableDebugger(ctx)
+}
+
+// scriptURL returns the URL of the script with the given ID
+func (s *scriptURLs) scriptURL(id string) string {
+	s.urlsMu.Lock()
+	defer s.urlsMu.Unlock()
+	return s.urls[id]
+}
+
+// EventListener extracts the functions listening for events of the given type from the DOM,
+// along with the node they're attached to and where they're defined. If Event is empty, then
+// listeners of every type found on the page are extracted.
 type EventListener struct {
+	scriptURLs
 	Event string
 }
 
@@ -22,10 +254,16 @@ func (t *EventListener) Priority() uint8 {
 }
 
 func (t *EventListener) Slug() string {
+	if t.Event == "" {
+		return "listeners"
+	}
 	return t.Event
 }
 
 func (t *EventListener) Description() string {
+	if t.Event == "" {
+		return "Extract event listeners of every type from the page"
+	}
 	return fmt.Sprintf("Extract all %s event listeners from the page", t.Event)
 }
 
@@ -33,64 +271,58 @@ func (t *EventListener) Init(c *config.Config) error {
 	return nil
 }
 
-func (t *EventListener) Run(ctx context.Context, url string, absDir string, relDir string) error {
-	f := fmt.Sprintf(`
-		(function(){
-			let nodes = [window, document];
-			let elements = document.querySelectorAll("*");
-			nodes.push.apply(nodes, elements);
-			let listeners = {};
-			nodes.forEach(function(e) { listeners = Object.assign({}, listeners, getEventListeners(e)); } );
-			let ret = {};
-			if ("%s" in listeners) {
-				listeners = listeners["%s"];
-				listeners.forEach(function(e) {
-					let name = e.listener.name;
-					let x = 1;
-					while (name in listeners) {
-						name = e.listener.name + x.toString();
-						x += 1;
-					}
-					if (name == "") {
-						name = "unnamed";
-					}
-					ret[name] = e.listener.toString();
-				});
-			}
-			return ret;
-		})()`, t.Event, t.Event)
+func (t *EventListener) PerFrame() bool {
+	return true
+}
 
-	var res map[string]string
-	tasks := chromedp.Tasks{
-		chromedp.EvaluateAsDevTools(f, &res),
+func (t *EventListener) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	return t.listenScripts(ctx)
+}
+
+func (t *EventListener) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	var types []string
+	if t.Event != "" {
+		types = []string{t.Event}
 	}
-	err := chromedp.Run(ctx, tasks)
+	listeners, err := getListeners(ctx, types)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to get %s listeners: %v", t.Slug(), err)
 	}
 
-	// Output
-	d := path.Join(absDir, "listeners", t.Event)
-	err = os.MkdirAll(d, os.ModePerm)
-	if err != nil {
-		return err
+	// Each type of listener gets its own output directory
+	byType := make(map[string][]*ListenerInfo)
+	for _, typ := range types {
+		byType[typ] = []*ListenerInfo{}
+	}
+	for _, l := range listeners {
+		l.URL = t.scriptURL(l.ScriptID)
+		byType[l.Type] = append(byType[l.Type], l)
 	}
 
-	for name, v := range res {
-		formatted, _ := jsbeautifier.Beautify(&v, jsbeautifier.DefaultOptions())
-
-		// Write original to file
-		p := path.Join(d, name)
-		if err := ioutil.WriteFile(p, []byte(v), 0644); err != nil {
+	for typ, listeners := range byType {
+		d := path.Join(absDir, "listeners", safeFilename(typ))
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
 			return err
 		}
 
-		// Write beautified version to file
-		p = path.Join(d, fmt.Sprintf("%s.beautified", name))
-		if err := ioutil.WriteFile(p, []byte(formatted), 0644); err != nil {
-			return err
+		for _, l := range listeners {
+			if err := writeBeautified(path.Join(d, l.Name), l.Source); err != nil {
+				return err
+			}
+		}
+
+		b, err := json.MarshalIndent(listeners, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode listeners: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(d, "listeners.json"), b, 0644); err != nil {
+			return fmt.Errorf("failed to write listeners to file: %v", err)
 		}
 	}
 
 	return nil
 }
+
+func (t *EventListener) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	return nil
+}
@@ -0,0 +1,398 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// Kinds of action taken by the Exercise task
+const (
+	ActionClick  = "click"
+	ActionFill   = "fill"
+	ActionSubmit = "submit"
+)
+
+// DefaultExerciseSkip matches elements which the Exercise task doesn't act on by default, as
+// they are likely to end the session or destroy data
+const DefaultExerciseSkip = `(?i)log[ _-]?(out|off)|sign[ _-]?(out|off)|delete|remove|destroy|deactivate|unsubscribe|(cancel|close)[ _-]?(account|subscription)`
+
+// exerciseFindJS returns the interactive elements which have appeared since it was last called,
+// giving each an ID that can be passed to exerciseActJS. Hidden elements are skipped, apart from
+// forms, which often only contain visible elements. The text of each element is returned along
+// with the attributes which say where it leads, so that it can be checked against the skip
+// pattern.
+const exerciseFindJS = `
+	(function() {
+		let s = window.__spydomExercise;
+		if (!s) {
+			s = window.__spydomExercise = {seen: new WeakSet(), elements: []};
+		}
+		let selector = "a[href], button, input, textarea, select, summary, form, [onclick], [role=button], [role=link], [role=tab], [tabindex]";
+		let ret = [];
+		document.querySelectorAll(selector).forEach(function(e) {
+			if (s.seen.has(e)) {
+				return;
+			}
+			s.seen.add(e);
+			let r = e.getBoundingClientRect();
+			if (e.localName !== "form" && (e.type === "hidden" || e.disabled || (r.width === 0 && r.height === 0))) {
+				return;
+			}
+
+			let kind = "click";
+			if (e.localName === "form") {
+				kind = "submit";
+			} else if (e.localName === "textarea" || e.localName === "select" ||
+				(e.localName === "input" && !/^(button|submit|reset|image|checkbox|radio|file)$/.test(e.type))) {
+				kind = "fill";
+			}
+
+			let desc = e.localName;
+			if (e.id) {
+				desc += "#" + e.id;
+			}
+			if (e.getAttribute("name")) {
+				desc += "[name=" + e.getAttribute("name") + "]";
+			}
+			if (e.getAttribute("href")) {
+				desc += "[href=" + e.getAttribute("href") + "]";
+			}
+			let label = (e.innerText || e.value || "").trim().replace(/\s+/g, " ").substr(0, 40);
+			if (label && kind !== "submit") {
+				desc += " " + JSON.stringify(label);
+			}
+
+			let text = [e.innerText, e.value, e.id, e.getAttribute("name"), e.getAttribute("href"),
+				e.getAttribute("action"), e.getAttribute("formaction"), e.getAttribute("aria-label"),
+				e.getAttribute("title"), e.form && e.form.getAttribute("action")];
+
+			s.elements.push(e);
+			ret.push({id: s.elements.length - 1, kind: kind, element: desc, text: text.filter(Boolean).join(" ")});
+		});
+		return ret;
+	})()`
+
+// exerciseActJS performs an action on the element with the given ID, returning false if the
+// element is no longer in the document. Inputs are filled with the given canary.
+const exerciseActJS = `
+	(function(id, kind, canary) {
+		let s = window.__spydomExercise;
+		let e = s && s.elements[id];
+		if (!e || !e.isConnected) {
+			return false;
+		}
+
+		function fill(e) {
+			if (e.localName === "select") {
+				if (e.options.length > 0) {
+					e.selectedIndex = e.options.length - 1;
+				}
+			} else if (e.type === "email") {
+				e.value = canary + "@example.com";
+			} else if (e.type === "number" || e.type === "range") {
+				e.value = "1";
+			} else {
+				e.value = canary;
+			}
+			e.dispatchEvent(new Event("input", {bubbles: true}));
+			e.dispatchEvent(new Event("change", {bubbles: true}));
+		}
+
+		// Keep links and forms in this tab rather than opening new ones
+		if (e.getAttribute("target")) {
+			e.removeAttribute("target");
+		}
+
+		if (kind === "fill") {
+			e.focus();
+			fill(e);
+		} else if (kind === "submit") {
+			e.querySelectorAll("input, textarea, select").forEach(function(i) {
+				if (!/^(hidden|button|submit|reset|image|checkbox|radio|file)$/.test(i.type)) {
+					fill(i);
+				}
+			});
+			if (e.requestSubmit) {
+				e.requestSubmit();
+			} else {
+				e.submit();
+			}
+		} else {
+			e.scrollIntoView({block: "center"});
+			e.click();
+		}
+		return true;
+	})(%d, %q, %q)`
+
+// snapshotJS returns the HTML of the document, without waiting for it to load
+const snapshotJS = `document.documentElement ? document.documentElement.outerHTML : ""`
+
+// exerciseCandidate is an element found by exerciseFindJS
+type exerciseCandidate struct {
+	ID      int    `json:"id"`
+	Kind    string `json:"kind"`
+	Element string `json:"element"`
+	Text    string `json:"text"`
+	depth   int
+}
+
+// ExerciseRequest is a request made by the page after an action
+type ExerciseRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Type   string `json:"type"`
+}
+
+// ExerciseAction records an action taken on an element, and its effects. Snapshot is the file
+// the DOM was saved to after the action, relative to the page's output directory. Error is set
+// if the action or snapshot failed, in which case the other effects may be missing.
+type ExerciseAction struct {
+	Kind        string             `json:"kind"`
+	Element     string             `json:"element"`
+	Depth       int                `json:"depth"`
+	Canary      string             `json:"canary,omitempty"`
+	URL         string             `json:"url"`
+	Navigated   bool               `json:"navigated"`
+	Reflected   bool               `json:"reflected"`
+	NewElements int                `json:"newElements"`
+	Snapshot    string             `json:"snapshot,omitempty"`
+	Requests    []*ExerciseRequest `json:"requests"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// ExerciseResult is written by the Exercise task. Skipped lists the elements which matched the
+// skip pattern.
+type ExerciseResult struct {
+	Limit   int               `json:"limit"`
+	Depth   int               `json:"depth"`
+	Actions []*ExerciseAction `json:"actions"`
+	Skipped []string          `json:"skipped,omitempty"`
+}
+
+// The Exercise task clicks the interactive elements on the page, fills inputs with canaries
+// and submits forms, so that listeners and client-side routes which only appear after user
+// interaction are exposed to later tasks. Elements which appear after an action are exercised
+// too, up to the configured depth. Elements matching the skip pattern, such as logout links,
+// are left alone.
+type Exercise struct {
+	limit int
+	depth int
+	skip  *regexp.Regexp
+
+	mu        sync.Mutex
+	frameID   cdp.FrameID
+	requests  []*ExerciseRequest
+	navigated bool
+}
+
+func (t *Exercise) Priority() uint8 {
+	return 0
+}
+
+func (t *Exercise) Slug() string {
+	return "exercise"
+}
+
+func (t *Exercise) Description() string {
+	return "Click interactive elements, fill inputs with canaries and submit forms, so that later modules see the state they expose"
+}
+
+func (t *Exercise) Init(c *config.Config) error {
+	t.limit = c.ExerciseLimit
+	t.depth = c.ExerciseDepth
+	if c.ExerciseSkip != "" {
+		var err error
+		if t.skip, err = regexp.Compile(c.ExerciseSkip); err != nil {
+			return fmt.Errorf("invalid exercise skip pattern: %v", err)
+		}
+	}
+	return nil
+}
+
+func (t *Exercise) Active() bool {
+	return true
+}
+
+func (t *Exercise) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	var loc string
+	var tree *page.FrameTree
+	err := chromedp.Run(ctx, chromedp.Location(&loc), chromedp.ActionFunc(func(c context.Context) error {
+		var err error
+		tree, err = page.GetFrameTree().Do(c)
+		return err
+	}), network.Enable())
+	if err != nil {
+		return fmt.Errorf("failed to prepare page: %v", err)
+	}
+
+	t.mu.Lock()
+	t.frameID = tree.Frame.ID
+	t.mu.Unlock()
+
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chromedp.ListenTarget(lctx, func(ev interface{}) {
+		if ev, ok := ev.(*network.EventRequestWillBeSent); ok {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.requests = append(t.requests, &ExerciseRequest{
+				Method: ev.Request.Method,
+				URL:    ev.Request.URL,
+				Type:   ev.Type.String(),
+			})
+			if ev.Type == network.ResourceTypeDocument && ev.FrameID == t.frameID {
+				t.navigated = true
+			}
+		}
+	})
+
+	snapshots := path.Join(absDir, "exercise")
+	if err := os.MkdirAll(snapshots, os.ModePerm); err != nil {
+		return err
+	}
+
+	// The actions taken so far are saved even if exercising the page fails part way through
+	res := &ExerciseResult{Limit: t.limit, Depth: t.depth, Actions: []*ExerciseAction{}}
+	exerciseErr := t.exercise(ctx, loc, absDir, res)
+
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode interaction results: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "exercise.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write interaction results to file: %v", err)
+	}
+	return exerciseErr
+}
+
+// exercise takes actions on the page's elements, adding them to res. Failed actions are
+// recorded and skipped, while errors which leave the page unusable are returned.
+func (t *Exercise) exercise(ctx context.Context, loc string, absDir string, res *ExerciseResult) error {
+	queue, err := findCandidates(ctx, 1)
+	if err != nil {
+		return err
+	}
+
+	// Elements are found in document order, so they keep their IDs when the page has to be
+	// reloaded, which stops them from being exercised again
+	done := make(map[string]bool)
+	for len(queue) > 0 && len(res.Actions) < t.limit {
+		c := queue[0]
+		queue = queue[1:]
+		key := fmt.Sprintf("%s %d %s", c.Kind, c.ID, c.Element)
+		if done[key] {
+			continue
+		}
+		done[key] = true
+		if t.skip != nil && t.skip.MatchString(c.Text) {
+			res.Skipped = append(res.Skipped, c.Element)
+			continue
+		}
+
+		t.mu.Lock()
+		t.requests = nil
+		t.navigated = false
+		t.mu.Unlock()
+
+		a := &ExerciseAction{Kind: c.Kind, Element: c.Element, Depth: c.depth}
+		if c.Kind != ActionClick {
+			a.Canary = newCanary()
+		}
+		var ok bool
+		if err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(exerciseActJS, c.ID, c.Kind, a.Canary), &ok)); err != nil {
+			// The document may have been replaced before the result was returned
+			t.mu.Lock()
+			ok = t.navigated
+			t.mu.Unlock()
+			if !ok {
+				a.Error = fmt.Sprintf("failed to %s: %v", c.Kind, err)
+				a.Requests = []*ExerciseRequest{}
+				res.Actions = append(res.Actions, a)
+				continue
+			}
+		}
+		if !ok {
+			continue
+		}
+		time.Sleep(fuzzWait)
+
+		// A late navigation can interrupt the snapshot, in which case the page is reloaded below
+		if err := t.snapshot(ctx, a, absDir, len(res.Actions)+1); err != nil {
+			a.Error = err.Error()
+		}
+
+		t.mu.Lock()
+		a.Requests = t.requests
+		a.Navigated = t.navigated
+		t.mu.Unlock()
+		if a.Requests == nil {
+			a.Requests = []*ExerciseRequest{}
+		}
+		res.Actions = append(res.Actions, a)
+
+		if a.Navigated {
+			// Go back to the page, which means starting again with the elements found on it
+			if err := reload(ctx, loc, ""); err != nil {
+				return err
+			}
+			if queue, err = findCandidates(ctx, 1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		found, err := findCandidates(ctx, c.depth+1)
+		if err != nil {
+			return err
+		}
+		a.NewElements = len(found)
+		if c.depth < t.depth {
+			queue = append(queue, found...)
+		}
+	}
+	return nil
+}
+
+// snapshot records the page's URL after an action, and saves its DOM as the nth snapshot
+func (t *Exercise) snapshot(ctx context.Context, a *ExerciseAction, absDir string, n int) error {
+	var html string
+	if err := chromedp.Run(ctx, chromedp.Location(&a.URL), chromedp.Evaluate(snapshotJS, &html)); err != nil {
+		return fmt.Errorf("failed to take snapshot: %v", err)
+	}
+	a.Reflected = a.Canary != "" && strings.Contains(html, a.Canary)
+
+	p := path.Join("exercise", strconv.Itoa(n)+".html")
+	if err := ioutil.WriteFile(path.Join(absDir, p), []byte(html), 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot to file: %v", err)
+	}
+	a.Snapshot = p
+	return nil
+}
+
+// findCandidates returns the interactive elements which have appeared on the page since it was
+// last called
+func findCandidates(ctx context.Context, depth int) ([]*exerciseCandidate, error) {
+	var ret []*exerciseCandidate
+	if err := chromedp.Run(ctx, chromedp.Evaluate(exerciseFindJS, &ret)); err != nil {
+		return nil, fmt.Errorf("failed to find interactive elements: %v", err)
+	}
+	for _, c := range ret {
+		c.depth = depth
+	}
+	return ret, nil
+}
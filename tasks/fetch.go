@@ -0,0 +1,155 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// fetchInPage fetches the given URL using fetch() from within the page, so that the request is
+// made with the page's cookies and the browser's network settings.
+func fetchInPage(ctx context.Context, u string) (string, error) {
+	quoted, err := json.Marshal(u)
+	if err != nil {
+		return "", err
+	}
+	expr := fmt.Sprintf(`fetch(%s, {credentials: "include"}).then(function(r) {
+		if (!r.ok) {
+			throw new Error("received status " + r.status);
+		}
+		return r.text();
+	})`, quoted)
+
+	var res string
+	err = chromedp.Run(ctx, chromedp.Evaluate(expr, &res, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+		return p.WithAwaitPromise(true)
+	}))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s: %v", u, err)
+	}
+	return res, nil
+}
+
+// resourceTimeout is how long to wait for a resource to load in the resourceLoader's tab
+const resourceTimeout = 10 * time.Second
+
+// resourceLoader downloads resources through the browser. They are fetched from the page
+// first, and if that fails, such as when CORS blocks a resource on another origin, they are
+// loaded in a separate tab instead, which isn't subject to CORS. Either way, the browser's
+// cookies are sent. close should be called once the loader is finished with.
+type resourceLoader struct {
+	page   context.Context
+	tab    context.Context
+	cancel context.CancelFunc
+}
+
+func newResourceLoader(ctx context.Context) *resourceLoader {
+	return &resourceLoader{page: ctx}
+}
+
+// load returns the body of the resource at u
+func (l *resourceLoader) load(u string) (string, error) {
+	body, err := fetchInPage(l.page, u)
+	if err == nil || strings.HasPrefix(u, "data:") {
+		return body, err
+	}
+	body, tabErr := l.loadInTab(u)
+	if tabErr != nil {
+		return "", fmt.Errorf("%v, and failed to load it in a new tab: %v", err, tabErr)
+	}
+	return body, nil
+}
+
+// loadInTab navigates the loader's tab to u, and returns the body of the response
+func (l *resourceLoader) loadInTab(u string) (string, error) {
+	if l.tab == nil {
+		l.tab, l.cancel = chromedp.NewContext(l.page)
+		if err := chromedp.Run(l.tab, network.Enable()); err != nil {
+			return "", fmt.Errorf("failed to open tab: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(l.tab, resourceTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var id network.RequestID
+	var status int64
+	done := make(chan error, 1)
+	finish := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch ev := ev.(type) {
+		case *network.EventResponseReceived:
+			if ev.Type == network.ResourceTypeDocument {
+				id, status = ev.RequestID, ev.Response.Status
+			}
+		case *network.EventLoadingFinished:
+			if ev.RequestID == id {
+				finish(nil)
+			}
+		case *network.EventLoadingFailed:
+			if ev.Type == network.ResourceTypeDocument {
+				finish(errors.New(ev.ErrorText))
+			}
+		}
+	})
+
+	if err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		_, _, errorText, err := page.Navigate(u).Do(c)
+		if err == nil && errorText != "" {
+			err = errors.New(errorText)
+		}
+		return err
+	})); err != nil {
+		return "", err
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", err
+		}
+	case <-ctx.Done():
+		return "", errors.New("timed out")
+	}
+
+	// The lock isn't held while running commands, as events are handled on the same goroutine
+	// as command responses
+	mu.Lock()
+	reqID, reqStatus := id, status
+	mu.Unlock()
+	if reqStatus >= 400 {
+		return "", fmt.Errorf("received status %d", reqStatus)
+	}
+	var body []byte
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		var err error
+		body, err = network.GetResponseBody(reqID).Do(c)
+		return err
+	}))
+	if err != nil {
+		return "", fmt.Errorf("failed to get response body: %v", err)
+	}
+	return string(body), nil
+}
+
+// close closes the loader's tab, if it was opened
+func (l *resourceLoader) close() {
+	if l.cancel != nil {
+		l.cancel()
+	}
+}
@@ -0,0 +1,286 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// Frame is a single frame in a page's frame tree. Dir is the directory, relative to the page's
+// output directory, that the output of tasks run in the frame is stored in. It is empty for
+// the main frame, and for frames that tasks can't be run in.
+type Frame struct {
+	ID             string   `json:"id"`
+	ParentID       string   `json:"parentId,omitempty"`
+	URL            string   `json:"url"`
+	Name           string   `json:"name,omitempty"`
+	SecurityOrigin string   `json:"securityOrigin"`
+	OutOfProcess   bool     `json:"outOfProcess"`
+	Dir            string   `json:"dir,omitempty"`
+	Children       []*Frame `json:"children"`
+
+	// session is the frame's own target, for out-of-process iframes
+	session *targetSession
+}
+
+// FrameTracker follows the frames of a page as it loads, so that tasks can be run in each of
+// them. Same-process frames are evaluated in through their default execution context, while
+// out-of-process iframes are attached to as separate targets.
+type FrameTracker struct {
+	mu       sync.Mutex
+	contexts map[cdp.FrameID]runtime.ExecutionContextID
+	parents  map[cdp.FrameID]cdp.FrameID
+	oopifs   map[target.SessionID]target.ID
+	attached []*targetSession
+}
+
+// NewFrameTracker starts tracking the frames of the page in ctx. It should be called before
+// navigating, and Close should be called once the page is finished with.
+func NewFrameTracker(ctx context.Context) *FrameTracker {
+	f := &FrameTracker{
+		contexts: make(map[cdp.FrameID]runtime.ExecutionContextID),
+		parents:  make(map[cdp.FrameID]cdp.FrameID),
+		oopifs:   make(map[target.SessionID]target.ID),
+	}
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		switch ev := ev.(type) {
+		case *runtime.EventExecutionContextCreated:
+			var aux struct {
+				IsDefault bool        `json:"isDefault"`
+				FrameID   cdp.FrameID `json:"frameId"`
+			}
+			if err := json.Unmarshal(ev.Context.AuxData, &aux); err == nil && aux.IsDefault {
+				f.contexts[aux.FrameID] = ev.Context.ID
+			}
+		case *runtime.EventExecutionContextDestroyed:
+			for id, c := range f.contexts {
+				if c == ev.ExecutionContextID {
+					delete(f.contexts, id)
+				}
+			}
+		case *runtime.EventExecutionContextsCleared:
+			f.contexts = make(map[cdp.FrameID]runtime.ExecutionContextID)
+		case *page.EventFrameAttached:
+			f.parents[ev.FrameID] = ev.ParentFrameID
+		case *target.EventAttachedToTarget:
+			// The target ID of an out-of-process iframe is the same as its frame ID
+			if ev.TargetInfo.Type == "iframe" {
+				f.oopifs[ev.SessionID] = ev.TargetInfo.TargetID
+			}
+		case *target.EventDetachedFromTarget:
+			delete(f.oopifs, ev.SessionID)
+		}
+	})
+	return f
+}
+
+// Discover returns the current frame tree of the page, along with every frame other than the
+// main frame that tasks can be run in. Page.getFrameTree leaves out out-of-process iframes, so
+// these are attached to and added to the tree beneath their parent. Out-of-process iframes
+// nested inside other out-of-process iframes aren't found. It should be called again whenever
+// the page may have been reloaded, which detaches from the frames found by the previous call.
+func (f *FrameTracker) Discover(ctx context.Context) (*Frame, []*Frame, error) {
+	f.Close()
+
+	var tree *page.FrameTree
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		var err error
+		tree, err = page.GetFrameTree().Do(c)
+		return err
+	}))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get frame tree: %v", err)
+	}
+
+	byID := make(map[string]*Frame)
+	root := convertFrameTree(tree, byID)
+
+	f.mu.Lock()
+	var ids []target.ID
+	for _, id := range f.oopifs {
+		ids = append(ids, id)
+	}
+	parents := make(map[cdp.FrameID]cdp.FrameID, len(f.parents))
+	for k, v := range f.parents {
+		parents[k] = v
+	}
+	f.mu.Unlock()
+
+	for _, id := range ids {
+		if _, ok := byID[string(id)]; ok {
+			continue
+		}
+
+		// The frame may have gone away since it was attached to
+		s, err := attachSession(ctx, id)
+		if err != nil {
+			continue
+		}
+		f.mu.Lock()
+		f.attached = append(f.attached, s)
+		f.mu.Unlock()
+		sub, err := page.GetFrameTree().Do(cdp.WithExecutor(ctx, s))
+		if err != nil {
+			continue
+		}
+
+		frame := convertFrameTree(sub, byID)
+		frame.OutOfProcess = true
+		frame.session = s
+		parent, ok := byID[string(parents[cdp.FrameID(id)])]
+		if !ok {
+			parent = root
+		}
+		frame.ParentID = parent.ID
+		parent.Children = append(parent.Children, frame)
+	}
+
+	// Give each frame that tasks can be run in its own output directory, in document order
+	var frames []*Frame
+	var walk func(*Frame, bool)
+	walk = func(fr *Frame, local bool) {
+		if fr != root && (fr.OutOfProcess || local) {
+			frames = append(frames, fr)
+			fr.Dir = path.Join("frames", strconv.Itoa(len(frames)))
+		}
+		for _, c := range fr.Children {
+			// Same-process frames inside out-of-process iframes belong to another target
+			walk(c, local && !fr.OutOfProcess)
+		}
+	}
+	walk(root, true)
+
+	return root, frames, nil
+}
+
+// convertFrameTree converts a frame tree returned by Page.getFrameTree, adding each frame to byID
+func convertFrameTree(tree *page.FrameTree, byID map[string]*Frame) *Frame {
+	fr := &Frame{
+		ID:             string(tree.Frame.ID),
+		ParentID:       string(tree.Frame.ParentID),
+		URL:            tree.Frame.URL + tree.Frame.URLFragment,
+		Name:           tree.Frame.Name,
+		SecurityOrigin: tree.Frame.SecurityOrigin,
+		Children:       []*Frame{},
+	}
+	byID[fr.ID] = fr
+	for _, c := range tree.ChildFrames {
+		fr.Children = append(fr.Children, convertFrameTree(c, byID))
+	}
+	return fr
+}
+
+type frameKey struct{}
+
+type frameSessionKey struct{}
+
+// WithFrame returns a context which runs tasks in fr rather than the main frame. Only tasks
+// which use runInFrame to run their actions, and inFrame when evaluating JavaScript, are
+// affected.
+func (f *FrameTracker) WithFrame(ctx context.Context, fr *Frame) (context.Context, error) {
+	if fr.OutOfProcess {
+		return context.WithValue(ctx, frameSessionKey{}, fr.session), nil
+	}
+
+	f.mu.Lock()
+	id, ok := f.contexts[cdp.FrameID(fr.ID)]
+	f.mu.Unlock()
+	if !ok {
+		return nil, errors.New("frame has no execution context")
+	}
+	return context.WithValue(ctx, frameKey{}, id), nil
+}
+
+// runInFrame runs actions in the out-of-process iframe given to WithFrame, if there is one, and
+// in the page otherwise
+func runInFrame(ctx context.Context, actions ...chromedp.Action) error {
+	if s, ok := ctx.Value(frameSessionKey{}).(*targetSession); ok {
+		return chromedp.Tasks(actions).Do(cdp.WithExecutor(ctx, s))
+	}
+	return chromedp.Run(ctx, actions...)
+}
+
+// inFrame returns an evaluate option which evaluates JavaScript in the frame given to
+// WithFrame, if there is one
+func inFrame(ctx context.Context) chromedp.EvaluateOption {
+	return func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+		if id, ok := ctx.Value(frameKey{}).(runtime.ExecutionContextID); ok {
+			return p.WithContextID(id)
+		}
+		return p
+	}
+}
+
+// Close detaches from any out-of-process iframes that were attached to by Discover
+func (f *FrameTracker) Close() {
+	f.mu.Lock()
+	attached := f.attached
+	f.attached = nil
+	f.mu.Unlock()
+
+	// The sessions may outlive the page's context, so they are detached from with a new one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, s := range attached {
+		s.detach(ctx)
+	}
+}
+
+type frameTreeKey struct{}
+
+// WithFrameTree returns a copy of ctx carrying the frame tree found by Discover
+func WithFrameTree(ctx context.Context, root *Frame) context.Context {
+	return context.WithValue(ctx, frameTreeKey{}, root)
+}
+
+// The Frames task saves the frame tree of the page, including out-of-process iframes
+type Frames struct{}
+
+func (t *Frames) Priority() uint8 {
+	return 1
+}
+
+func (t *Frames) Slug() string {
+	return "frames"
+}
+
+func (t *Frames) Description() string {
+	return "Save the frame tree of the page, including out-of-process iframes"
+}
+
+func (t *Frames) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *Frames) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	root, ok := ctx.Value(frameTreeKey{}).(*Frame)
+	if !ok {
+		return errors.New("the frame tree was not discovered")
+	}
+
+	b, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode frame tree: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "frames.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write frame tree to file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// mutationObserverJS starts counting DOM mutations, resetting the count if it's already running
+const mutationObserverJS = `
+	(function() {
+		window.__spydomMutations = 0;
+		if (!window.__spydomObserver) {
+			window.__spydomObserver = new MutationObserver(function(m) {
+				window.__spydomMutations += m.length;
+			});
+			window.__spydomObserver.observe(document, {
+				childList: true,
+				subtree: true,
+				attributes: true,
+				characterData: true
+			});
+		}
+	})()`
+
+// mutationCountJS returns the number of DOM mutations since the count was last reset
+const mutationCountJS = `window.__spydomMutations || 0`
+
+// hashPayloads returns the values to set location.hash to, each built around its own canary
+func hashPayloads() []fuzzPayload {
+	var ret []fuzzPayload
+	add := func(format string) {
+		c := newCanary()
+		ret = append(ret, fuzzPayload{Canary: c, Value: fmt.Sprintf(format, c)})
+	}
+
+	add(`%s`)
+	add(`<img src=x onerror=alert("%s")>`)
+	add(`"><svg onload=alert("%s")>`)
+	add(`%%3Cimg%%20src%%3Dx%%20onerror%%3Dalert(%%22%s%%22)%%3E`)
+	add(`javascript:alert("%s")`)
+	add(`//%s.example.com/`)
+	add(`https://%s.example.com/`)
+	add(`../../../%s`)
+	add(`..%%2f..%%2f..%%2f%s`)
+	add(`/%s/../../../`)
+	add(`!/%s`)
+	add(`/%s?x=%[1]s`)
+	add(`%s=<img src=x onerror=alert("%[1]s")>&x=%[1]s`)
+	return ret
+}
+
+// HashFinding records a payload which had an observable effect on the page
+type HashFinding struct {
+	Payload     string     `json:"payload"`
+	Canary      string     `json:"canary"`
+	Mutations   int        `json:"mutations"`
+	Navigations []string   `json:"navigations,omitempty"`
+	Hits        []*SinkHit `json:"hits,omitempty"`
+}
+
+// HashFuzzResult is written by the HashFuzz task
+type HashFuzzResult struct {
+	Listeners int            `json:"listeners"`
+	Sent      int            `json:"sent"`
+	Baseline  int            `json:"baseline"`
+	Findings  []*HashFinding `json:"findings"`
+}
+
+// The HashFuzz task sets location.hash to a series of payloads on pages with hashchange
+// listeners, and records those which cause navigations, DOM changes, dialogs or sink hits
+type HashFuzz struct {
+	sinkRecorder
+
+	mu          sync.Mutex
+	navigations []string
+}
+
+func (t *HashFuzz) Priority() uint8 {
+	return 3
+}
+
+func (t *HashFuzz) Slug() string {
+	return "hashfuzz"
+}
+
+func (t *HashFuzz) Description() string {
+	return "Fuzz hashchange listeners by setting location.hash to crafted payloads, and record the effects"
+}
+
+func (t *HashFuzz) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *HashFuzz) Active() bool {
+	return true
+}
+
+func (t *HashFuzz) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.navigations = nil
+	t.mu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		if ev, ok := ev.(*network.EventRequestWillBeSent); ok && ev.Type == network.ResourceTypeDocument {
+			t.mu.Lock()
+			t.navigations = append(t.navigations, ev.Request.URL)
+			t.mu.Unlock()
+		}
+	})
+
+	if err := t.listenSinks(ctx); err != nil {
+		return fmt.Errorf("failed to install sink hooks: %v", err)
+	}
+	return nil
+}
+
+func (t *HashFuzz) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	listeners, err := getListeners(ctx, []string{"hashchange"})
+	if err != nil {
+		return fmt.Errorf("failed to get hashchange listeners: %v", err)
+	}
+	n := 0
+	for _, l := range listeners {
+		if l.Node == "window" {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+
+	var loc string
+	if err := chromedp.Run(ctx, chromedp.Location(&loc)); err != nil {
+		return fmt.Errorf("failed to retrieve page location: %v", err)
+	}
+
+	// Some pages change the DOM constantly, so count the mutations made without any payload
+	res := &HashFuzzResult{Listeners: n, Findings: []*HashFinding{}}
+	if res.Baseline, err = t.countMutations(ctx, nil); err != nil {
+		return err
+	}
+
+	for _, p := range hashPayloads() {
+		t.mu.Lock()
+		t.navigations = nil
+		t.mu.Unlock()
+
+		payload := p.Value.(string)
+		mutations, err := t.countMutations(ctx, chromedp.ActionFunc(func(c context.Context) error {
+			b, err := json.Marshal(payload)
+			if err != nil {
+				return err
+			}
+			var ignored []byte
+			return chromedp.Evaluate(fmt.Sprintf("location.hash = %s", b), &ignored).Do(c)
+		}))
+		if err != nil {
+			return err
+		}
+		res.Sent++
+
+		t.mu.Lock()
+		navigations := t.navigations
+		t.mu.Unlock()
+
+		f := &HashFinding{
+			Payload:     payload,
+			Canary:      p.Canary,
+			Mutations:   mutations,
+			Navigations: navigations,
+			Hits:        t.sinkHits(p.Canary),
+		}
+		if f.Mutations > res.Baseline || len(f.Navigations) > 0 || len(f.Hits) > 0 {
+			res.Findings = append(res.Findings, f)
+		}
+
+		if len(navigations) > 0 {
+			if err := reload(ctx, loc, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Leave the page as it was found for any later tasks
+	if err := reload(ctx, loc, ""); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode hashchange fuzzing results: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "hashfuzz.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write hashchange fuzzing results to file: %v", err)
+	}
+	return nil
+}
+
+// countMutations runs the action, if there is one, and returns the number of DOM mutations made
+// while waiting for the page to handle it
+func (t *HashFuzz) countMutations(ctx context.Context, action chromedp.Action) (int, error) {
+	var ignored []byte
+	if err := chromedp.Run(ctx, chromedp.Evaluate(mutationObserverJS, &ignored)); err != nil {
+		return 0, fmt.Errorf("failed to observe DOM mutations: %v", err)
+	}
+	if action != nil {
+		if err := chromedp.Run(ctx, action); err != nil {
+			return 0, fmt.Errorf("failed to set location.hash: %v", err)
+		}
+	}
+	time.Sleep(fuzzWait)
+
+	// The count is lost if the page navigated away
+	var n int
+	if err := chromedp.Run(ctx, chromedp.Evaluate(mutationCountJS, &n)); err != nil {
+		return 0, nil
+	}
+	return n, nil
+}
+
+func (t *HashFuzz) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	return t.removeSinks(ctx)
+}
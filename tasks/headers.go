@@ -0,0 +1,294 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// Header is a single response header. Repeated headers are stored as separate Headers.
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HeaderIssue describes a security header that is missing or weakly configured
+type HeaderIssue struct {
+	Header  string `json:"header"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail"`
+}
+
+// ResourceHeaders holds the response headers for a single request
+type ResourceHeaders struct {
+	URL     string   `json:"url"`
+	Status  int64    `json:"status"`
+	Type    string   `json:"type,omitempty"`
+	Headers []Header `json:"headers"`
+}
+
+// HeadersResult is the output of the Headers task
+type HeadersResult struct {
+	Document  *ResourceHeaders   `json:"document"`
+	Issues    []HeaderIssue      `json:"issues"`
+	Resources []*ResourceHeaders `json:"resources,omitempty"`
+}
+
+// The Headers task saves the response headers of the page, and audits its security headers
+type Headers struct {
+	documentResponses
+	all bool
+
+	mu        sync.Mutex
+	resources []*ResourceHeaders
+}
+
+func (t *Headers) Priority() uint8 {
+	return 1
+}
+
+func (t *Headers) Slug() string {
+	return "headers"
+}
+
+func (t *Headers) Description() string {
+	return "Save the response headers of the page and report missing or weak security headers"
+}
+
+func (t *Headers) Init(c *config.Config) error {
+	t.all = c.AllHeaders
+	return nil
+}
+
+func (t *Headers) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.resources = nil
+	t.mu.Unlock()
+
+	if t.all {
+		chromedp.ListenTarget(ctx, func(ev interface{}) {
+			if ev, ok := ev.(*network.EventResponseReceived); ok {
+				r := &ResourceHeaders{
+					URL:     ev.Response.URL,
+					Status:  ev.Response.Status,
+					Type:    ev.Type.String(),
+					Headers: sortedHeaders(ev.Response.Headers),
+				}
+				t.mu.Lock()
+				t.resources = append(t.resources, r)
+				t.mu.Unlock()
+			}
+		})
+	}
+
+	return t.listenDocuments(ctx)
+}
+
+func (t *Headers) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	// Output is written by Teardown so that all subresources are included
+	return nil
+}
+
+func (t *Headers) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	doc := t.mainDocument()
+	if doc == nil {
+		// The page failed to load, which has already been reported
+		return nil
+	}
+
+	res := HeadersResult{
+		Document: &ResourceHeaders{
+			URL:     doc.Response.URL,
+			Status:  doc.Response.Status,
+			Headers: sortedHeaders(doc.Response.Headers),
+		},
+	}
+	res.Issues = auditHeaders(doc.Response.URL, res.Document.Headers)
+
+	t.mu.Lock()
+	res.Resources = t.resources
+	t.mu.Unlock()
+
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode headers: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "headers.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write headers to file: %v", err)
+	}
+
+	return nil
+}
+
+// sortedHeaders converts headers to a list sorted by name. Chrome joins repeated headers with
+// newlines, and these are split back out into separate Headers.
+func sortedHeaders(headers network.Headers) []Header {
+	ret := []Header{}
+	for k, v := range headers {
+		for _, line := range strings.Split(fmt.Sprint(v), "\n") {
+			ret = append(ret, Header{k, line})
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return strings.ToLower(ret[i].Name) < strings.ToLower(ret[j].Name)
+	})
+	return ret
+}
+
+// getHeader returns the value of all headers with the given name joined with commas, and
+// whether any were found
+func getHeader(headers []Header, name string) (string, bool) {
+	var vals []string
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			vals = append(vals, h.Value)
+		}
+	}
+	return strings.Join(vals, ", "), len(vals) > 0
+}
+
+// parseCSP parses a Content-Security-Policy into a map of directive names to their sources
+func parseCSP(policy string) map[string][]string {
+	ret := make(map[string][]string)
+	// Multiple policies are joined by getHeader with commas
+	for _, p := range strings.Split(policy, ",") {
+		for _, d := range strings.Split(p, ";") {
+			fields := strings.Fields(strings.ToLower(d))
+			if len(fields) == 0 {
+				continue
+			}
+			if _, exists := ret[fields[0]]; !exists {
+				ret[fields[0]] = fields[1:]
+			}
+		}
+	}
+	return ret
+}
+
+var hstsMaxAge = regexp.MustCompile(`(?i)max-age\s*=\s*"?(\d+)`)
+
+// auditHeaders checks the security headers of a document, returning any which are missing
+// or weakly configured
+func auditHeaders(u string, headers []Header) []HeaderIssue {
+	issues := []HeaderIssue{}
+	add := func(header, problem, detail string) {
+		issues = append(issues, HeaderIssue{header, problem, detail})
+	}
+
+	// Content-Security-Policy
+	csp, hasCSP := getHeader(headers, "Content-Security-Policy")
+	directives := parseCSP(csp)
+	if !hasCSP {
+		if _, ok := getHeader(headers, "Content-Security-Policy-Report-Only"); ok {
+			add("Content-Security-Policy", "weak", "Only a report-only policy is set, so it is not enforced")
+		} else {
+			add("Content-Security-Policy", "missing", "No Content-Security-Policy header is set")
+		}
+	} else {
+		scriptSrc, ok := directives["script-src"]
+		if !ok {
+			scriptSrc, ok = directives["default-src"]
+		}
+		if !ok {
+			add("Content-Security-Policy", "weak", "Neither script-src nor default-src are set, so scripts are unrestricted")
+		}
+		hasNonce := false
+		for _, s := range scriptSrc {
+			if strings.HasPrefix(s, "'nonce-") || strings.HasPrefix(s, "'sha") || s == "'strict-dynamic'" {
+				hasNonce = true
+			}
+		}
+		for _, s := range scriptSrc {
+			switch s {
+			case "'unsafe-inline'":
+				if !hasNonce {
+					add("Content-Security-Policy", "weak", "Scripts allow 'unsafe-inline'")
+				}
+			case "'unsafe-eval'":
+				add("Content-Security-Policy", "weak", "Scripts allow 'unsafe-eval'")
+			case "*", "http:", "https:", "data:":
+				add("Content-Security-Policy", "weak", fmt.Sprintf("Scripts may be loaded from %s", s))
+			}
+		}
+		if _, ok := directives["object-src"]; !ok {
+			if _, ok := directives["default-src"]; !ok {
+				add("Content-Security-Policy", "weak", "Neither object-src nor default-src are set, so plugins are unrestricted")
+			}
+		}
+	}
+
+	// Strict-Transport-Security, which is only meaningful over HTTPS
+	if parsed, err := neturl.Parse(u); err == nil && parsed.Scheme == "https" {
+		hsts, ok := getHeader(headers, "Strict-Transport-Security")
+		if !ok {
+			add("Strict-Transport-Security", "missing", "No Strict-Transport-Security header is set")
+		} else if m := hstsMaxAge.FindStringSubmatch(hsts); m == nil {
+			add("Strict-Transport-Security", "weak", "No max-age is set")
+		} else if age, _ := strconv.Atoi(m[1]); age < 15552000 {
+			add("Strict-Transport-Security", "weak", fmt.Sprintf("max-age of %d is less than 180 days", age))
+		}
+	}
+
+	// X-Frame-Options, which can be superseded by the CSP frame-ancestors directive
+	xfo, ok := getHeader(headers, "X-Frame-Options")
+	_, hasAncestors := directives["frame-ancestors"]
+	if !ok && !hasAncestors {
+		add("X-Frame-Options", "missing", "Neither X-Frame-Options nor the frame-ancestors CSP directive are set")
+	} else if ok && !hasAncestors {
+		v := strings.ToUpper(strings.TrimSpace(xfo))
+		if v != "DENY" && v != "SAMEORIGIN" {
+			add("X-Frame-Options", "weak", fmt.Sprintf("Value '%s' is not DENY or SAMEORIGIN", xfo))
+		}
+	}
+
+	// X-Content-Type-Options
+	if xcto, ok := getHeader(headers, "X-Content-Type-Options"); !ok {
+		add("X-Content-Type-Options", "missing", "No X-Content-Type-Options header is set")
+	} else if strings.ToLower(strings.TrimSpace(xcto)) != "nosniff" {
+		add("X-Content-Type-Options", "weak", fmt.Sprintf("Value '%s' is not nosniff", xcto))
+	}
+
+	// Referrer-Policy
+	if rp, ok := getHeader(headers, "Referrer-Policy"); !ok {
+		add("Referrer-Policy", "missing", "No Referrer-Policy header is set")
+	} else {
+		for _, p := range strings.Split(strings.ToLower(rp), ",") {
+			p = strings.TrimSpace(p)
+			if p == "unsafe-url" || p == "no-referrer-when-downgrade" {
+				add("Referrer-Policy", "weak", fmt.Sprintf("Policy '%s' leaks full URLs to other origins", p))
+			}
+		}
+	}
+
+	// Permissions-Policy
+	if _, ok := getHeader(headers, "Permissions-Policy"); !ok {
+		if _, ok := getHeader(headers, "Feature-Policy"); ok {
+			add("Permissions-Policy", "weak", "Only the deprecated Feature-Policy header is set")
+		} else {
+			add("Permissions-Policy", "missing", "No Permissions-Policy header is set")
+		}
+	}
+
+	// Cross-Origin-Opener-Policy and Cross-Origin-Embedder-Policy
+	for _, h := range []string{"Cross-Origin-Opener-Policy", "Cross-Origin-Embedder-Policy"} {
+		if v, ok := getHeader(headers, h); !ok {
+			add(h, "missing", fmt.Sprintf("No %s header is set", h))
+		} else if strings.HasPrefix(strings.ToLower(strings.TrimSpace(v)), "unsafe-none") {
+			add(h, "weak", "Value is unsafe-none")
+		}
+	}
+
+	return issues
+}
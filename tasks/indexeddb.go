@@ -0,0 +1,257 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/chromedp/cdproto/cachestorage"
+	"github.com/chromedp/cdproto/indexeddb"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// StorageDump is the IndexedDB databases and Cache Storage caches of an origin
+type StorageDump struct {
+	Origin    string               `json:"origin"`
+	IndexedDB []*IndexedDBDatabase `json:"indexedDB"`
+	Caches    []*CacheInfo         `json:"caches"`
+}
+
+// IndexedDBDatabase is a single IndexedDB database
+type IndexedDBDatabase struct {
+	Name         string                  `json:"name"`
+	Version      float64                 `json:"version"`
+	ObjectStores []*IndexedDBObjectStore `json:"objectStores"`
+}
+
+// IndexedDBObjectStore is an object store in an IndexedDB database. Count is the total number
+// of records in the store, of which at most the configured limit are saved.
+type IndexedDBObjectStore struct {
+	Name          string             `json:"name"`
+	KeyPath       string             `json:"keyPath,omitempty"`
+	AutoIncrement bool               `json:"autoIncrement"`
+	Indexes       []string           `json:"indexes"`
+	Count         int64              `json:"count"`
+	Records       []*IndexedDBRecord `json:"records"`
+	Truncated     bool               `json:"truncated"`
+}
+
+// IndexedDBRecord is a record in an object store. Values which can't be represented as JSON,
+// such as dates and blobs, are replaced with their description.
+type IndexedDBRecord struct {
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// CacheInfo is a single Cache Storage cache. Count is the total number of entries in the cache,
+// of which at most the configured limit are saved.
+type CacheInfo struct {
+	Name      string        `json:"name"`
+	Count     int64         `json:"count"`
+	Entries   []*CacheEntry `json:"entries"`
+	Truncated bool          `json:"truncated"`
+}
+
+// CacheEntry is a request stored in a cache, along with a summary of its response
+type CacheEntry struct {
+	URL          string `json:"url"`
+	Method       string `json:"method"`
+	Status       int64  `json:"status"`
+	ResponseType string `json:"responseType"`
+}
+
+// objectValueJS returns the object it is called on, so that it can be returned by value
+const objectValueJS = `function() { return this; }`
+
+// The IndexedDB task saves the IndexedDB databases and Cache Storage caches of the page's origin
+type IndexedDB struct {
+	limit int64
+}
+
+func (t *IndexedDB) Priority() uint8 {
+	return 1
+}
+
+func (t *IndexedDB) Slug() string {
+	return "indexeddb"
+}
+
+func (t *IndexedDB) Description() string {
+	return "Save the IndexedDB databases and Cache Storage caches of the page's origin"
+}
+
+func (t *IndexedDB) Init(c *config.Config) error {
+	t.limit = int64(c.StorageLimit)
+	return nil
+}
+
+func (t *IndexedDB) PerFrame() bool {
+	return true
+}
+
+func (t *IndexedDB) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	var origin string
+	if err := runInFrame(ctx, chromedp.Evaluate("location.origin", &origin, inFrame(ctx))); err != nil {
+		return fmt.Errorf("failed to retrieve page origin: %v", err)
+	}
+
+	dump := &StorageDump{Origin: origin, IndexedDB: []*IndexedDBDatabase{}, Caches: []*CacheInfo{}}
+	// Pages such as about:blank and data: URLs have opaque origins, which have no storage
+	if origin != "null" {
+		if err := runInFrame(ctx, chromedp.ActionFunc(func(c context.Context) error {
+			var err error
+			if dump.IndexedDB, err = t.indexedDB(c, origin); err != nil {
+				return fmt.Errorf("failed to dump IndexedDB: %v", err)
+			}
+			if dump.Caches, err = t.caches(c, origin); err != nil {
+				return fmt.Errorf("failed to dump Cache Storage: %v", err)
+			}
+			return nil
+		})); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode storage: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "indexeddb.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write storage to file: %v", err)
+	}
+	return nil
+}
+
+// indexedDB dumps every IndexedDB database of the origin
+func (t *IndexedDB) indexedDB(ctx context.Context, origin string) ([]*IndexedDBDatabase, error) {
+	if err := indexeddb.Enable().Do(ctx); err != nil {
+		return nil, err
+	}
+	defer indexeddb.Disable().Do(ctx)
+
+	names, err := indexeddb.RequestDatabaseNames(origin).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*IndexedDBDatabase{}
+	for _, name := range names {
+		db, err := indexeddb.RequestDatabase(origin, name).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		d := &IndexedDBDatabase{Name: db.Name, Version: db.Version, ObjectStores: []*IndexedDBObjectStore{}}
+		for _, s := range db.ObjectStores {
+			store := &IndexedDBObjectStore{
+				Name:          s.Name,
+				KeyPath:       keyPathString(s.KeyPath),
+				AutoIncrement: s.AutoIncrement,
+				Indexes:       []string{},
+				Records:       []*IndexedDBRecord{},
+			}
+			for _, i := range s.Indexes {
+				store.Indexes = append(store.Indexes, i.Name)
+			}
+
+			count, _, err := indexeddb.GetMetadata(origin, name, s.Name).Do(ctx)
+			if err != nil {
+				return nil, err
+			}
+			store.Count = int64(count)
+
+			entries, hasMore, err := indexeddb.RequestData(origin, name, s.Name, "", 0, t.limit).Do(ctx)
+			if err != nil {
+				return nil, err
+			}
+			store.Truncated = hasMore
+			for _, e := range entries {
+				store.Records = append(store.Records, &IndexedDBRecord{
+					Key:   remoteObjectJSON(ctx, e.PrimaryKey),
+					Value: remoteObjectJSON(ctx, e.Value),
+				})
+			}
+			d.ObjectStores = append(d.ObjectStores, store)
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// keyPathString converts an object store's key path to a string
+func keyPathString(k *indexeddb.KeyPath) string {
+	if k == nil {
+		return ""
+	}
+	if k.Type == indexeddb.KeyPathTypeArray {
+		return "[" + strings.Join(k.Array, ", ") + "]"
+	}
+	return k.String
+}
+
+// remoteObjectJSON converts a remote object to JSON, returning a string containing its
+// description if it can't be represented as JSON
+func remoteObjectJSON(ctx context.Context, o *runtime.RemoteObject) json.RawMessage {
+	description := func(s string) json.RawMessage {
+		b, _ := json.Marshal(s)
+		return b
+	}
+
+	switch {
+	case o == nil || o.Type == runtime.TypeUndefined:
+		return json.RawMessage("null")
+	case len(o.Value) > 0:
+		return json.RawMessage(o.Value)
+	case o.UnserializableValue != "":
+		return description(o.UnserializableValue.String())
+	case o.ObjectID == "":
+		return description(o.Description)
+	case o.Subtype != "" && o.Subtype != runtime.SubtypeArray:
+		// Dates, blobs, typed arrays and the like serialise to empty objects
+		return description(o.Description)
+	}
+
+	res, exp, err := runtime.CallFunctionOn(objectValueJS).
+		WithObjectID(o.ObjectID).
+		WithReturnByValue(true).
+		Do(ctx)
+	runtime.ReleaseObject(o.ObjectID).Do(ctx)
+	if err != nil || exp != nil || len(res.Value) == 0 {
+		return description(o.Description)
+	}
+	return json.RawMessage(res.Value)
+}
+
+// caches lists every Cache Storage cache of the origin, along with the requests stored in it
+func (t *IndexedDB) caches(ctx context.Context, origin string) ([]*CacheInfo, error) {
+	caches, err := cachestorage.RequestCacheNames(origin).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*CacheInfo{}
+	for _, c := range caches {
+		entries, count, err := cachestorage.RequestEntries(c.CacheID).WithSkipCount(0).WithPageSize(t.limit).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		info := &CacheInfo{Name: c.CacheName, Count: int64(count), Entries: []*CacheEntry{}}
+		for _, e := range entries {
+			info.Entries = append(info.Entries, &CacheEntry{
+				URL:          e.RequestURL,
+				Method:       e.RequestMethod,
+				Status:       e.ResponseStatus,
+				ResponseType: e.ResponseType.String(),
+			})
+		}
+		info.Truncated = info.Count > int64(len(info.Entries))
+		ret = append(ret, info)
+	}
+	return ret, nil
+}
@@ -50,12 +50,16 @@ func (t *JSRunner) Init(c *config.Config) error {
 	return fmt.Errorf("no JavaScript specified")
 }
 
+func (t *JSRunner) PerFrame() bool {
+	return true
+}
+
 func (t *JSRunner) Run(ctx context.Context, url string, absDir string, relDir string) error {
 	var res string
 	tasks := chromedp.Tasks{
-		chromedp.EvaluateAsDevTools(t.script, &res),
+		chromedp.EvaluateAsDevTools(t.script, &res, inFrame(ctx)),
 	}
-	err := chromedp.Run(ctx, tasks)
+	err := runInFrame(ctx, tasks)
 	if err != nil {
 		return fmt.Errorf("failed to run custom JavaScript: %v", err)
 	}
@@ -29,14 +29,18 @@ func (t *LocalStorage) Init(c *config.Config) error {
 	return nil
 }
 
+func (t *LocalStorage) PerFrame() bool {
+	return true
+}
+
 func (t *LocalStorage) Run(ctx context.Context, url string, absDir string, relDir string) error {
 	var localStorage string
 	var sessionStorage string
 	tasks := chromedp.Tasks{
-		chromedp.EvaluateAsDevTools("JSON.stringify(localStorage)", &localStorage),
-		chromedp.EvaluateAsDevTools("JSON.stringify(sessionStorage)", &sessionStorage),
+		chromedp.EvaluateAsDevTools("JSON.stringify(localStorage)", &localStorage, inFrame(ctx)),
+		chromedp.EvaluateAsDevTools("JSON.stringify(sessionStorage)", &sessionStorage, inFrame(ctx)),
 	}
-	if err := chromedp.Run(ctx, tasks); err != nil {
+	if err := runInFrame(ctx, tasks); err != nil {
 		return fmt.Errorf("failed to retrieve local storage: %v", err)
 	}
 
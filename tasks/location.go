@@ -2,19 +2,68 @@ package tasks
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path"
+	"sync"
 
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
 	"github.com/danielthatcher/spydom/config"
 )
 
-// The Location task saves the requested url and final location to files
-type Location struct{}
+// Causes of a navigation in a redirect chain
+const (
+	CauseInitial     = "initial"
+	CauseHTTP        = "http"
+	CauseMetaRefresh = "meta refresh"
+	CauseRefresh     = "refresh header"
+	CauseJavaScript  = "javascript"
+	CauseForm        = "form"
+	CauseLink        = "link"
+	CauseReload      = "reload"
+	CauseOther       = "other"
+)
+
+// RedirectHop is a single document requested by the main frame while the page loaded
+type RedirectHop struct {
+	URL             string `json:"url"`
+	Cause           string `json:"cause"`
+	Status          int64  `json:"status,omitempty"`
+	StatusText      string `json:"statusText,omitempty"`
+	MimeType        string `json:"mimeType,omitempty"`
+	RemoteIPAddress string `json:"remoteIPAddress,omitempty"`
+	RemotePort      int64  `json:"remotePort,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+}
+
+// RedirectChain records how the requested URL led to the final URL. The last hop is the main
+// document that was loaded.
+type RedirectChain struct {
+	Requested string         `json:"requested"`
+	Final     string         `json:"final"`
+	Hops      []*RedirectHop `json:"hops"`
+	Document  *RedirectHop   `json:"document,omitempty"`
+}
+
+// The Location task saves the requested url and final location to files, along with the chain of
+// redirects between them
+type Location struct {
+	mu        sync.Mutex
+	closed    bool
+	frameID   cdp.FrameID
+	hops      []*RedirectHop
+	byRequest map[network.RequestID]*RedirectHop
+	pending   string
+}
 
+// Priority is 0 so that the final URL and redirect chain are recorded before any task
+// interacts with the page
 func (t *Location) Priority() uint8 {
-	return 1
+	return 0
 }
 
 func (t *Location) Slug() string {
@@ -22,13 +71,116 @@ func (t *Location) Slug() string {
 }
 
 func (t *Location) Description() string {
-	return "Save the requested URL and the final URL of the loaded page"
+	return "Save the requested URL and the final URL of the loaded page, along with the redirects between them"
 }
 
 func (t *Location) Init(c *config.Config) error {
 	return nil
 }
 
+func (t *Location) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	// The main frame keeps its ID when it navigates
+	var tree *page.FrameTree
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		var err error
+		tree, err = page.GetFrameTree().Do(c)
+		return err
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to get frame tree: %v", err)
+	}
+
+	t.mu.Lock()
+	t.closed = false
+	t.frameID = tree.Frame.ID
+	t.hops = nil
+	t.byRequest = make(map[network.RequestID]*RedirectHop)
+	t.pending = ""
+	t.mu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.closed {
+			return
+		}
+
+		switch ev := ev.(type) {
+		case *page.EventFrameRequestedNavigation:
+			if ev.FrameID == t.frameID {
+				t.pending = navigationCause(ev.Reason)
+			}
+		case *network.EventRequestWillBeSent:
+			if ev.Type != network.ResourceTypeDocument || ev.FrameID != t.frameID {
+				return
+			}
+
+			cause := t.pending
+			t.pending = ""
+			if ev.RedirectResponse != nil {
+				if h, ok := t.byRequest[ev.RequestID]; ok {
+					setResponse(h, ev.RedirectResponse)
+				}
+				cause = CauseHTTP
+			} else if cause == "" {
+				switch {
+				case len(t.hops) == 0:
+					cause = CauseInitial
+				case ev.Initiator != nil && ev.Initiator.Type == network.InitiatorTypeScript:
+					cause = CauseJavaScript
+				default:
+					cause = CauseOther
+				}
+			}
+
+			h := &RedirectHop{URL: ev.Request.URL, Cause: cause}
+			t.hops = append(t.hops, h)
+			t.byRequest[ev.RequestID] = h
+		case *network.EventResponseReceived:
+			if ev.Type != network.ResourceTypeDocument || ev.FrameID != t.frameID {
+				return
+			}
+			if h, ok := t.byRequest[ev.RequestID]; ok {
+				setResponse(h, ev.Response)
+			}
+		}
+	})
+
+	if err := chromedp.Run(ctx, network.Enable()); err != nil {
+		return fmt.Errorf("failed to enable network events: %v", err)
+	}
+	return nil
+}
+
+// navigationCause converts the reason for a renderer-initiated navigation to a cause
+func navigationCause(r page.ClientNavigationReason) string {
+	switch r {
+	case page.ClientNavigationReasonMetaTagRefresh:
+		return CauseMetaRefresh
+	case page.ClientNavigationReasonHTTPHeaderRefresh:
+		return CauseRefresh
+	case page.ClientNavigationReasonScriptInitiated:
+		return CauseJavaScript
+	case page.ClientNavigationReasonFormSubmissionGet, page.ClientNavigationReasonFormSubmissionPost:
+		return CauseForm
+	case page.ClientNavigationReasonAnchorClick:
+		return CauseLink
+	case page.ClientNavigationReasonReload:
+		return CauseReload
+	}
+	return CauseOther
+}
+
+// setResponse records the details of a response in a hop
+func setResponse(h *RedirectHop, r *network.Response) {
+	h.Status = r.Status
+	h.StatusText = r.StatusText
+	h.MimeType = r.MimeType
+	h.RemoteIPAddress = r.RemoteIPAddress
+	h.RemotePort = r.RemotePort
+	h.Protocol = r.Protocol
+}
+
 func (t *Location) Run(ctx context.Context, url string, absDir string, relDir string) error {
 	var newurl string
 	tasks := chromedp.Tasks{chromedp.Location(&newurl)}
@@ -47,5 +199,29 @@ func (t *Location) Run(ctx context.Context, url string, absDir string, relDir st
 		return fmt.Errorf("failed to write final url to file: %v", err)
 	}
 
+	// Later tasks may load the page again, so stop recording once the page has loaded
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	chain := &RedirectChain{Requested: url, Final: newurl, Hops: t.hops}
+	if chain.Hops == nil {
+		chain.Hops = []*RedirectHop{}
+	}
+	if len(t.hops) > 0 {
+		chain.Document = t.hops[len(t.hops)-1]
+	}
+	b, err := json.MarshalIndent(chain, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode redirect chain: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "redirects.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write redirect chain to file: %v", err)
+	}
+
+	return nil
+}
+
+func (t *Location) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
 	return nil
 }
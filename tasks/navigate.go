@@ -0,0 +1,45 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/chromedp/chromedp"
+)
+
+// ReloadFunc loads u in a fresh document, sending the given referrer if it isn't empty, and
+// waits for it to load
+type ReloadFunc func(ctx context.Context, u string, referrer string) error
+
+type reloadKey struct{}
+
+// WithReload returns a copy of ctx which lets tasks load the page again with f, for example
+// with payloads injected into the URL
+func WithReload(ctx context.Context, f ReloadFunc) context.Context {
+	return context.WithValue(ctx, reloadKey{}, f)
+}
+
+// reload loads u in a fresh document using the function given to WithReload
+func reload(ctx context.Context, u string, referrer string) error {
+	f, ok := ctx.Value(reloadKey{}).(ReloadFunc)
+	if !ok {
+		return errors.New("reloading the page is not supported")
+	}
+	if err := f(ctx, u, referrer); err != nil {
+		return fmt.Errorf("failed to load %s: %v", u, err)
+	}
+	return nil
+}
+
+// restoreLocation loads loc again if a payload has caused the page to navigate away from it
+func restoreLocation(ctx context.Context, loc string) error {
+	var cur string
+	if err := chromedp.Run(ctx, chromedp.Location(&cur)); err != nil {
+		return fmt.Errorf("failed to retrieve page location: %v", err)
+	}
+	if cur == loc {
+		return nil
+	}
+	return reload(ctx, loc, "")
+}
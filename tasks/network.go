@@ -0,0 +1,421 @@
+package tasks
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/har"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// networkRequest holds everything seen about a single request while the page was loaded.
+// Each hop of a redirect is recorded as a separate request.
+type networkRequest struct {
+	id        network.RequestID
+	started   time.Time
+	timestamp float64
+	request   *network.Request
+	initiator *network.Initiator
+	resType   network.ResourceType
+	response  *network.Response
+	finished  float64
+	size      float64
+	errorText string
+}
+
+// harLog mirrors har.Log, but allows the custom fields in harEntry to be written
+type harLog struct {
+	Version string       `json:"version"`
+	Creator *har.Creator `json:"creator"`
+	Pages   []*har.Page  `json:"pages"`
+	Entries []*harEntry  `json:"entries"`
+}
+
+// harEntry mirrors har.Entry with the addition of some custom fields. The HAR spec requires
+// custom fields to start with an underscore.
+type harEntry struct {
+	Pageref         string             `json:"pageref"`
+	StartedDateTime string             `json:"startedDateTime"`
+	Time            float64            `json:"time"`
+	Request         *har.Request       `json:"request"`
+	Response        *har.Response      `json:"response"`
+	Cache           *har.Cache         `json:"cache"`
+	Timings         *har.Timings       `json:"timings"`
+	ServerIPAddress string             `json:"serverIPAddress,omitempty"`
+	Connection      string             `json:"connection,omitempty"`
+	Initiator       *network.Initiator `json:"_initiator,omitempty"`
+	ResourceType    string             `json:"_resourceType,omitempty"`
+	Error           string             `json:"_error,omitempty"`
+}
+
+// The Network task records all requests made by the page and saves them as a HAR file
+type Network struct {
+	bodies bool
+
+	mu            sync.Mutex
+	requests      []*networkRequest
+	current       map[network.RequestID]*networkRequest
+	contentLoaded float64
+	loaded        float64
+}
+
+func (t *Network) Priority() uint8 {
+	return 1
+}
+
+func (t *Network) Slug() string {
+	return "network"
+}
+
+func (t *Network) Description() string {
+	return "Record all requests made by the page and save them as a HAR file"
+}
+
+func (t *Network) Init(c *config.Config) error {
+	t.bodies = c.NetworkBodies
+	return nil
+}
+
+func (t *Network) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.requests = nil
+	t.current = make(map[network.RequestID]*networkRequest)
+	t.contentLoaded = 0
+	t.loaded = 0
+	t.mu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		switch ev := ev.(type) {
+		case *network.EventRequestWillBeSent:
+			// Redirects reuse the request ID of the original request
+			if r, ok := t.current[ev.RequestID]; ok && ev.RedirectResponse != nil {
+				r.response = ev.RedirectResponse
+				r.finished = monotonicSeconds(ev.Timestamp)
+			}
+			r := &networkRequest{
+				id:        ev.RequestID,
+				started:   time.Now(),
+				timestamp: monotonicSeconds(ev.Timestamp),
+				request:   ev.Request,
+				initiator: ev.Initiator,
+				resType:   ev.Type,
+			}
+			if ev.WallTime != nil {
+				r.started = ev.WallTime.Time()
+			}
+			t.requests = append(t.requests, r)
+			t.current[ev.RequestID] = r
+		case *network.EventResponseReceived:
+			if r, ok := t.current[ev.RequestID]; ok {
+				r.response = ev.Response
+			}
+		case *network.EventLoadingFinished:
+			if r, ok := t.current[ev.RequestID]; ok {
+				r.finished = monotonicSeconds(ev.Timestamp)
+				r.size = ev.EncodedDataLength
+			}
+		case *network.EventLoadingFailed:
+			if r, ok := t.current[ev.RequestID]; ok {
+				r.finished = monotonicSeconds(ev.Timestamp)
+				r.errorText = ev.ErrorText
+			}
+		case *page.EventDomContentEventFired:
+			if t.contentLoaded == 0 {
+				t.contentLoaded = monotonicSeconds(ev.Timestamp)
+			}
+		case *page.EventLoadEventFired:
+			if t.loaded == 0 {
+				t.loaded = monotonicSeconds(ev.Timestamp)
+			}
+		}
+	})
+
+	if err := chromedp.Run(ctx, network.Enable()); err != nil {
+		return fmt.Errorf("failed to enable network events: %v", err)
+	}
+	return nil
+}
+
+func (t *Network) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	// The HAR file is written by Teardown so that requests made while running other tasks
+	// are included
+	return nil
+}
+
+func (t *Network) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	requests := make([]*networkRequest, len(t.requests))
+	copy(requests, t.requests)
+	current := make(map[network.RequestID]*networkRequest, len(t.current))
+	for k, v := range t.current {
+		current[k] = v
+	}
+	contentLoaded, loaded := t.contentLoaded, t.loaded
+	t.mu.Unlock()
+
+	pg := &har.Page{
+		ID:          "page_1",
+		Title:       url,
+		PageTimings: &har.PageTimings{OnContentLoad: -1, OnLoad: -1},
+	}
+	if len(requests) > 0 {
+		pg.StartedDateTime = requests[0].started.Format(time.RFC3339Nano)
+		if contentLoaded > 0 {
+			pg.PageTimings.OnContentLoad = (contentLoaded - requests[0].timestamp) * 1000
+		}
+		if loaded > 0 {
+			pg.PageTimings.OnLoad = (loaded - requests[0].timestamp) * 1000
+		}
+	}
+
+	out := harLog{
+		Version: "1.2",
+		Creator: &har.Creator{Name: "spydom", Version: "0"},
+		Pages:   []*har.Page{pg},
+		Entries: make([]*harEntry, 0, len(requests)),
+	}
+	for _, r := range requests {
+		e := r.harEntry(pg.ID)
+
+		// Only the final hop of a redirect has a body
+		if t.bodies && r.response != nil && r.errorText == "" && current[r.id] == r {
+			var body []byte
+			err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+				var err error
+				body, err = network.GetResponseBody(r.id).Do(c)
+				return err
+			}))
+			if err == nil {
+				if isText(r.response.MimeType) {
+					e.Response.Content.Text = string(body)
+				} else {
+					e.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+					e.Response.Content.Encoding = "base64"
+				}
+				e.Response.Content.Size = int64(len(body))
+			}
+		}
+		out.Entries = append(out.Entries, e)
+	}
+
+	b, err := json.MarshalIndent(struct {
+		Log harLog `json:"log"`
+	}{out}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode HAR: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "network.har"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write HAR file: %v", err)
+	}
+
+	return nil
+}
+
+// harEntry converts the request to its HAR representation
+func (r *networkRequest) harEntry(pageref string) *harEntry {
+	e := &harEntry{
+		Pageref:         pageref,
+		StartedDateTime: r.started.Format(time.RFC3339Nano),
+		Cache:           &har.Cache{},
+		Timings:         &har.Timings{},
+		Initiator:       r.initiator,
+		ResourceType:    r.resType.String(),
+		Error:           r.errorText,
+	}
+
+	headers := r.request.Headers
+	httpVersion := ""
+	if r.response != nil {
+		if len(r.response.RequestHeaders) > 0 {
+			headers = r.response.RequestHeaders
+		}
+		httpVersion = harHTTPVersion(r.response.Protocol)
+	}
+
+	e.Request = &har.Request{
+		Method:      r.request.Method,
+		URL:         r.request.URL,
+		HTTPVersion: httpVersion,
+		Cookies:     harCookies(headerValue(headers, "Cookie"), ";"),
+		Headers:     harHeaders(headers),
+		QueryString: []*har.NameValuePair{},
+		HeadersSize: -1,
+		BodySize:    int64(len(r.request.PostData)),
+	}
+	if u, err := url.Parse(r.request.URL); err == nil {
+		for k, vs := range u.Query() {
+			for _, v := range vs {
+				e.Request.QueryString = append(e.Request.QueryString, &har.NameValuePair{Name: k, Value: v})
+			}
+		}
+	}
+	if r.request.PostData != "" {
+		e.Request.PostData = &har.PostData{
+			MimeType: headerValue(headers, "Content-Type"),
+			Params:   []*har.Param{},
+			Text:     r.request.PostData,
+		}
+	}
+
+	e.Response = &har.Response{
+		Cookies:     []*har.Cookie{},
+		Headers:     []*har.NameValuePair{},
+		Content:     &har.Content{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if r.response == nil {
+		return e
+	}
+
+	e.Response.Status = r.response.Status
+	e.Response.StatusText = r.response.StatusText
+	e.Response.HTTPVersion = httpVersion
+	e.Response.Cookies = harCookies(headerValue(r.response.Headers, "Set-Cookie"), "\n")
+	e.Response.Headers = harHeaders(r.response.Headers)
+	e.Response.Content.MimeType = r.response.MimeType
+	e.Response.Content.Size = int64(r.size)
+	e.Response.RedirectURL = headerValue(r.response.Headers, "Location")
+	if r.size > 0 {
+		e.Response.BodySize = int64(r.size)
+	}
+	e.ServerIPAddress = r.response.RemoteIPAddress
+	e.Connection = fmt.Sprintf("%.0f", r.response.ConnectionID)
+
+	// Convert Chrome's timings, which are relative to the request time, into HAR timings
+	if tm := r.response.Timing; tm != nil {
+		e.Timings.Blocked = firstNonNegative(tm.DNSStart, tm.ConnectStart, tm.SendStart)
+		if tm.DNSStart >= 0 {
+			e.Timings.DNS = tm.DNSEnd - tm.DNSStart
+		}
+		if tm.ConnectStart >= 0 {
+			e.Timings.Connect = tm.ConnectEnd - tm.ConnectStart
+		}
+		if tm.SslStart >= 0 {
+			e.Timings.Ssl = tm.SslEnd - tm.SslStart
+		}
+		e.Timings.Send = tm.SendEnd - tm.SendStart
+		e.Timings.Wait = tm.ReceiveHeadersEnd - tm.SendEnd
+		e.Timings.Receive = 0
+		if r.finished > 0 {
+			e.Timings.Receive = (r.finished-tm.RequestTime)*1000 - tm.ReceiveHeadersEnd
+		}
+		for _, v := range []float64{e.Timings.Blocked, e.Timings.DNS, e.Timings.Connect, e.Timings.Send, e.Timings.Wait, e.Timings.Receive} {
+			if v > 0 {
+				e.Time += v
+			}
+		}
+	}
+
+	return e
+}
+
+// monotonicSeconds converts a timestamp from Chrome to the number of seconds used by the
+// timing fields of a response
+func monotonicSeconds(t *cdp.MonotonicTime) float64 {
+	if t == nil {
+		return 0
+	}
+	return t.Time().Sub(*cdp.MonotonicTimeEpoch).Seconds()
+}
+
+func firstNonNegative(vals ...float64) float64 {
+	for _, v := range vals {
+		if v >= 0 {
+			return v
+		}
+	}
+	return -1
+}
+
+// harHTTPVersion converts a protocol as reported by Chrome, such as "h2", to the form used in HAR files
+func harHTTPVersion(protocol string) string {
+	switch strings.ToLower(protocol) {
+	case "h2":
+		return "HTTP/2.0"
+	case "h3", "h3-29", "quic":
+		return "HTTP/3.0"
+	case "":
+		return ""
+	}
+	return strings.ToUpper(protocol)
+}
+
+// headerValue returns the value of the named header, ignoring case
+func headerValue(headers network.Headers, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// harHeaders converts headers to a sorted list of name-value pairs. Chrome joins repeated
+// headers with newlines, and these are split back out into separate pairs.
+func harHeaders(headers network.Headers) []*har.NameValuePair {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	ret := []*har.NameValuePair{}
+	for _, k := range names {
+		for _, v := range strings.Split(fmt.Sprint(headers[k]), "\n") {
+			ret = append(ret, &har.NameValuePair{Name: k, Value: v})
+		}
+	}
+	return ret
+}
+
+// harCookies parses the name and value of each cookie in a Cookie or Set-Cookie header
+func harCookies(header string, sep string) []*har.Cookie {
+	ret := []*har.Cookie{}
+	if header == "" {
+		return ret
+	}
+	for _, c := range strings.Split(header, sep) {
+		// Set-Cookie attributes follow the first semicolon
+		c = strings.TrimSpace(strings.SplitN(c, ";", 2)[0])
+		kv := strings.SplitN(c, "=", 2)
+		if kv[0] == "" {
+			continue
+		}
+		cookie := &har.Cookie{Name: kv[0]}
+		if len(kv) == 2 {
+			cookie.Value = kv[1]
+		}
+		ret = append(ret, cookie)
+	}
+	return ret
+}
+
+// isText returns whether responses with the given MIME type can be saved as text
+func isText(mimeType string) bool {
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	for _, s := range []string{"javascript", "json", "xml", "html", "css", "svg"} {
+		if strings.Contains(mimeType, s) {
+			return true
+		}
+	}
+	return false
+}
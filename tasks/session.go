@@ -0,0 +1,142 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/chromedp/cdproto"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+	"github.com/mailru/easyjson"
+)
+
+// targetSession is a session with a target, such as a worker or an out-of-process iframe, which
+// is owned by spydom rather than chromedp. chromedp enables page domains on every target it
+// attaches to, which workers don't have, and closes targets it attached to when finished with
+// them, which would remove iframes from the page. Commands are instead sent through
+// Target.sendMessageToTarget on a session that isn't flattened. The session is attached to
+// through the page's own session, so that chromedp doesn't see it being detached from. It
+// implements cdp.Executor, so it can be used with the commands in cdproto.
+type targetSession struct {
+	page   cdp.Executor
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	id      target.SessionID
+	next    int64
+	pending map[int64]chan *cdproto.Message
+}
+
+// attachSession attaches to the target with the given ID
+func attachSession(ctx context.Context, id target.ID) (*targetSession, error) {
+	c := chromedp.FromContext(ctx)
+	if c == nil || c.Target == nil {
+		return nil, chromedp.ErrInvalidContext
+	}
+
+	lctx, cancel := context.WithCancel(ctx)
+	s := &targetSession{
+		page:    c.Target,
+		cancel:  cancel,
+		pending: make(map[int64]chan *cdproto.Message),
+	}
+
+	chromedp.ListenTarget(lctx, func(ev interface{}) {
+		e, ok := ev.(*target.EventReceivedMessageFromTarget)
+		if !ok {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if e.SessionID != s.id {
+			return
+		}
+		var msg cdproto.Message
+		if err := json.Unmarshal([]byte(e.Message), &msg); err != nil {
+			return
+		}
+		if ch, ok := s.pending[msg.ID]; ok {
+			delete(s.pending, msg.ID)
+			ch <- &msg
+		}
+	})
+
+	sessionID, err := target.AttachToTarget(id).WithFlatten(false).Do(cdp.WithExecutor(ctx, s.page))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to attach to target: %v", err)
+	}
+	s.mu.Lock()
+	s.id = sessionID
+	s.mu.Unlock()
+	return s, nil
+}
+
+// sendMessageParams are the parameters of Target.sendMessageToTarget, which cdproto no longer
+// includes
+type sendMessageParams struct {
+	Message   string           `json:"message"`
+	SessionID target.SessionID `json:"sessionId"`
+}
+
+func (s *targetSession) Execute(ctx context.Context, method string, params easyjson.Marshaler, res easyjson.Unmarshaler) error {
+	var buf []byte
+	if params != nil {
+		var err error
+		if buf, err = easyjson.Marshal(params); err != nil {
+			return err
+		}
+	}
+
+	ch := make(chan *cdproto.Message, 1)
+	s.mu.Lock()
+	s.next++
+	id := s.next
+	s.pending[id] = ch
+	sessionID := s.id
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+
+	msg, err := json.Marshal(&cdproto.Message{ID: id, Method: cdproto.MethodType(method), Params: buf})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(sendMessageParams{Message: string(msg), SessionID: sessionID})
+	if err != nil {
+		return err
+	}
+	raw := easyjson.RawMessage(b)
+	if err := s.page.Execute(ctx, "Target.sendMessageToTarget", &raw, nil); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case m := <-ch:
+		if m.Error != nil {
+			return m.Error
+		}
+		if res != nil {
+			return easyjson.Unmarshal(m.Result, res)
+		}
+		return nil
+	}
+}
+
+// detach detaches from the target and stops listening for its messages
+func (s *targetSession) detach(ctx context.Context) {
+	s.mu.Lock()
+	id := s.id
+	s.mu.Unlock()
+	target.DetachFromTarget().WithSessionID(id).Do(cdp.WithExecutor(ctx, s.page))
+	s.cancel()
+}
@@ -0,0 +1,314 @@
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// CanaryPrefix starts every canary value injected into pages, and is what the sink hooks look
+// for in the values passed to sinks
+const CanaryPrefix = "spyd0m"
+
+// sinkBinding is the name of the binding called by the sink hooks to report a canary reaching
+// a sink
+const sinkBinding = "__spydomSink"
+
+// fuzzWait is how long to wait after injecting each payload for the page to handle it
+const fuzzWait = 500 * time.Millisecond
+
+// sinkHooksJS wraps dangerous DOM sinks so that any value containing a canary is reported
+// through the sink binding, along with a stack trace. It is installed in every frame before
+// any of the page's scripts run. eval and the Function constructor aren't wrapped, as that
+// would turn direct eval calls into indirect ones, so they are caught by the debugger instead.
+var sinkHooksJS = fmt.Sprintf(`
+	(function() {
+		if (window.__spydomHooked) {
+			return;
+		}
+		Object.defineProperty(window, "__spydomHooked", {value: true});
+
+		const binding = %q;
+		const marker = %q;
+		function report(sink, value) {
+			let s;
+			try {
+				s = String(value);
+			} catch (e) {
+				return;
+			}
+			let i = s.indexOf(marker);
+			let b = window[binding];
+			if (i === -1 || typeof b !== "function") {
+				return;
+			}
+			b(JSON.stringify({
+				sink: sink,
+				value: s.substr(Math.max(0, i - 100), 300),
+				stack: new Error().stack,
+				url: location.href
+			}));
+		}
+
+		function hookSetter(proto, prop, sink) {
+			let d = proto && Object.getOwnPropertyDescriptor(proto, prop);
+			if (!d || !d.set) {
+				return;
+			}
+			Object.defineProperty(proto, prop, Object.assign({}, d, {
+				set: function(v) {
+					report(sink, v);
+					return d.set.call(this, v);
+				}
+			}));
+		}
+
+		function hookMethod(obj, prop, sink, check) {
+			let orig = obj && obj[prop];
+			if (typeof orig !== "function") {
+				return;
+			}
+			let wrapped = function() {
+				check.call(this, arguments);
+				return orig.apply(this, arguments);
+			};
+			wrapped.prototype = orig.prototype;
+			obj[prop] = wrapped;
+		}
+
+		function args(sink, indexes) {
+			return function(a) {
+				for (let i = 0; i < a.length; i++) {
+					if (indexes === null || indexes.indexOf(i) !== -1) {
+						report(sink, a[i]);
+					}
+				}
+			};
+		}
+
+		function stringArg(sink) {
+			return function(a) {
+				if (typeof a[0] === "string") {
+					report(sink, a[0]);
+				}
+			};
+		}
+
+		hookSetter(Element.prototype, "innerHTML", "innerHTML");
+		hookSetter(Element.prototype, "outerHTML", "outerHTML");
+		hookMethod(Element.prototype, "insertAdjacentHTML", "insertAdjacentHTML", args("insertAdjacentHTML", [1]));
+		hookMethod(Document.prototype, "write", "document.write", args("document.write", null));
+		hookMethod(Document.prototype, "writeln", "document.writeln", args("document.writeln", null));
+		hookMethod(Range.prototype, "createContextualFragment", "createContextualFragment", args("createContextualFragment", [0]));
+		hookMethod(window, "setTimeout", "setTimeout", stringArg("setTimeout"));
+		hookMethod(window, "setInterval", "setInterval", stringArg("setInterval"));
+		hookMethod(window, "open", "window.open", args("window.open", [0]));
+		hookMethod(Element.prototype, "setAttribute", "setAttribute", function(a) {
+			let name = String(a[0]).toLowerCase();
+			if (["src", "href", "srcdoc", "action", "formaction", "data"].indexOf(name) !== -1 || name.startsWith("on")) {
+				report("setAttribute('" + name + "')", a[1]);
+			}
+		});
+		hookSetter(window.HTMLScriptElement && HTMLScriptElement.prototype, "src", "script.src");
+		hookSetter(window.HTMLScriptElement && HTMLScriptElement.prototype, "text", "script.text");
+		hookSetter(window.HTMLIFrameElement && HTMLIFrameElement.prototype, "src", "iframe.src");
+		hookSetter(window.HTMLIFrameElement && HTMLIFrameElement.prototype, "srcdoc", "iframe.srcdoc");
+		hookSetter(window.HTMLAnchorElement && HTMLAnchorElement.prototype, "href", "a.href");
+		hookSetter(window.HTMLFormElement && HTMLFormElement.prototype, "action", "form.action");
+	})();`, sinkBinding, CanaryPrefix)
+
+// SinkHit records a canary reaching a dangerous sink
+type SinkHit struct {
+	Sink  string `json:"sink"`
+	Value string `json:"value"`
+	Stack string `json:"stack"`
+	URL   string `json:"url"`
+}
+
+// newCanary returns a new unique canary value
+func newCanary() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return CanaryPrefix + hex.EncodeToString(b)
+}
+
+// sinkRecorder installs the sink hooks into a page and records the hits reported by them. As
+// navigations and code compiled at runtime can't be hooked from JavaScript without changing how
+// the page behaves, these are detected through CDP events instead.
+// It is intended to be embedded in tasks implementing the LifecycleTask interface.
+type sinkRecorder struct {
+	sinkMu     sync.Mutex
+	hits       []*SinkHit
+	hooksID    page.ScriptIdentifier
+	hooksAdded bool
+}
+
+// listenSinks installs the sink hooks, and starts recording hits
+func (s *sinkRecorder) listenSinks(ctx context.Context) error {
+	s.sinkMu.Lock()
+	s.hits = nil
+	s.sinkMu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		var hit *SinkHit
+		switch ev := ev.(type) {
+		case *runtime.EventBindingCalled:
+			if ev.Name != sinkBinding {
+				return
+			}
+			hit = &SinkHit{}
+			if err := json.Unmarshal([]byte(ev.Payload), hit); err != nil {
+				return
+			}
+		case *network.EventRequestWillBeSent:
+			// Only navigations started by scripts are of interest, which also excludes those
+			// made by tasks to inject canaries
+			if ev.Type != network.ResourceTypeDocument || ev.Initiator == nil || ev.Initiator.Type != network.InitiatorTypeScript {
+				return
+			}
+			if !strings.Contains(ev.Request.URL, CanaryPrefix) {
+				return
+			}
+			hit = &SinkHit{
+				Sink:  "location",
+				Value: ev.Request.URL,
+				Stack: formatStack(ev.Initiator.Stack),
+				URL:   ev.DocumentURL,
+			}
+		case *page.EventFrameRequestedNavigation:
+			// Navigations to javascript: URLs don't result in a request
+			if !strings.HasPrefix(strings.ToLower(ev.URL), "javascript:") || !strings.Contains(ev.URL, CanaryPrefix) {
+				return
+			}
+			hit = &SinkHit{Sink: "location", Value: ev.URL}
+		case *page.EventJavascriptDialogOpening:
+			// The worker answers dialogs, so they just need recording here
+			if !strings.Contains(ev.Message, CanaryPrefix) {
+				return
+			}
+			hit = &SinkHit{Sink: ev.Type.String(), Value: ev.Message, URL: ev.URL}
+		case *debugger.EventScriptParsed:
+			// Code compiled by eval or the Function constructor has no URL, and has the stack
+			// of the script which compiled it, unlike code evaluated by spydom itself
+			if ev.URL != "" || ev.StackTrace == nil || len(ev.StackTrace.CallFrames) == 0 {
+				return
+			}
+			go s.checkEval(ctx, ev)
+			return
+		default:
+			return
+		}
+
+		s.sinkMu.Lock()
+		s.hits = append(s.hits, hit)
+		s.sinkMu.Unlock()
+	})
+
+	if err := enableDebugger(ctx); err != nil {
+		return err
+	}
+	return chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		if err := network.Enable().Do(c); err != nil {
+			return err
+		}
+		if err := runtime.AddBinding(sinkBinding).Do(c); err != nil {
+			return err
+		}
+		id, err := page.AddScriptToEvaluateOnNewDocument(sinkHooksJS).Do(c)
+		if err != nil {
+			return err
+		}
+		s.sinkMu.Lock()
+		s.hooksID = id
+		s.hooksAdded = true
+		s.sinkMu.Unlock()
+		return nil
+	}))
+}
+
+// checkEval records a hit if the source of a script compiled at runtime contains a canary
+func (s *sinkRecorder) checkEval(ctx context.Context, ev *debugger.EventScriptParsed) {
+	var src string
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		var err error
+		src, _, err = debugger.GetScriptSource(ev.ScriptID).Do(c)
+		return err
+	}))
+	i := strings.Index(src, CanaryPrefix)
+	if err != nil || i == -1 {
+		return
+	}
+
+	sink := "eval"
+	if strings.HasPrefix(src, "(function anonymous(") {
+		sink = "Function"
+	}
+	start := i - 100
+	if start < 0 {
+		start = 0
+	}
+	end := start + 300
+	if end > len(src) {
+		end = len(src)
+	}
+
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	s.hits = append(s.hits, &SinkHit{
+		Sink:  sink,
+		Value: src[start:end],
+		Stack: formatStack(ev.StackTrace),
+		URL:   ev.StackTrace.CallFrames[0].URL,
+	})
+}
+
+// removeSinks stops the sink hooks from being installed in new documents
+func (s *sinkRecorder) removeSinks(ctx context.Context) error {
+	s.sinkMu.Lock()
+	id, added := s.hooksID, s.hooksAdded
+	s.hooksAdded = false
+	s.sinkMu.Unlock()
+	if !added {
+		return nil
+	}
+	return chromedp.Run(ctx, page.RemoveScriptToEvaluateOnNewDocument(id))
+}
+
+// sinkHits returns the hits recorded for the given canary
+func (s *sinkRecorder) sinkHits(canary string) []*SinkHit {
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	var ret []*SinkHit
+	for _, h := range s.hits {
+		if strings.Contains(h.Value, canary) {
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
+
+// formatStack formats a stack trace from CDP in the same way as Error.stack
+func formatStack(st *runtime.StackTrace) string {
+	var lines []string
+	for ; st != nil; st = st.Parent {
+		for _, f := range st.CallFrames {
+			name := f.FunctionName
+			if name == "" {
+				name = "<anonymous>"
+			}
+			lines = append(lines, fmt.Sprintf("    at %s (%s:%d:%d)", name, f.URL, f.LineNumber+1, f.ColumnNumber+1))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
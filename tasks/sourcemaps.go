@@ -0,0 +1,263 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// sourceMap holds the parts of a source map needed to reconstruct the original sources
+type sourceMap struct {
+	SourceRoot     string    `json:"sourceRoot"`
+	Sources        []string  `json:"sources"`
+	SourcesContent []*string `json:"sourcesContent"`
+	Sections       []struct {
+		Map *sourceMap `json:"map"`
+	} `json:"sections"`
+}
+
+// SourceMapInfo describes a source map found by the SourceMaps task. SourceErrors lists the
+// sources which couldn't be recovered from the map.
+type SourceMapInfo struct {
+	Script       string   `json:"script"`
+	URL          string   `json:"url"`
+	File         string   `json:"file,omitempty"`
+	Sources      []string `json:"sources"`
+	SourceErrors []string `json:"sourceErrors,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// The SourceMaps task finds source maps for the scripts parsed by the page, and reconstructs
+// the original sources from them
+type SourceMaps struct {
+	mu      sync.Mutex
+	scripts map[string]string
+	headers map[string]string
+}
+
+func (t *SourceMaps) Priority() uint8 {
+	return 1
+}
+
+func (t *SourceMaps) Slug() string {
+	return "sourcemaps"
+}
+
+func (t *SourceMaps) Description() string {
+	return "Download source maps for the page's scripts and reconstruct the original sources"
+}
+
+func (t *SourceMaps) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *SourceMaps) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.scripts = make(map[string]string)
+	t.headers = make(map[string]string)
+	t.mu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		switch ev := ev.(type) {
+		case *debugger.EventScriptParsed:
+			// Chrome parses sourceMappingURL comments for us
+			if ev.SourceMapURL != "" && ev.URL != "" {
+				t.scripts[ev.URL] = ev.SourceMapURL
+			}
+		case *network.EventResponseReceived:
+			if ev.Type != network.ResourceTypeScript {
+				return
+			}
+			for _, h := range []string{"SourceMap", "X-SourceMap"} {
+				if v := headerValue(ev.Response.Headers, h); v != "" {
+					t.headers[ev.Response.URL] = v
+				}
+			}
+		}
+	})
+
+	if err := chromedp.Run(ctx, network.Enable()); err != nil {
+		return fmt.Errorf("failed to enable network events: %v", err)
+	}
+	return enableDebugger(ctx)
+}
+
+func (t *SourceMaps) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	maps := make(map[string]string, len(t.scripts)+len(t.headers))
+	for k, v := range t.scripts {
+		maps[k] = v
+	}
+	// The SourceMap header takes precedence over comments
+	for k, v := range t.headers {
+		maps[k] = v
+	}
+	t.mu.Unlock()
+
+	l := newResourceLoader(ctx)
+	defer l.close()
+
+	d := path.Join(absDir, "sourcemaps")
+	infos := []*SourceMapInfo{}
+	fetched := make(map[string]*SourceMapInfo)
+	scripts := make([]string, 0, len(maps))
+	for script := range maps {
+		scripts = append(scripts, script)
+	}
+	sort.Strings(scripts)
+	for _, script := range scripts {
+		m := maps[script]
+		info := &SourceMapInfo{Script: script, URL: m, Sources: []string{}}
+		infos = append(infos, info)
+
+		base, err := neturl.Parse(script)
+		if err != nil {
+			info.Error = err.Error()
+			continue
+		}
+		ref, err := neturl.Parse(m)
+		if err != nil {
+			info.Error = err.Error()
+			continue
+		}
+		mapURL := base.ResolveReference(ref)
+		info.URL = mapURL.String()
+		if mapURL.Scheme == "data" {
+			info.URL = "(inline)"
+		}
+
+		// Bundles split into several scripts can share a single map
+		if prev, ok := fetched[mapURL.String()]; ok {
+			info.File, info.Sources, info.SourceErrors, info.Error = prev.File, prev.Sources, prev.SourceErrors, prev.Error
+			continue
+		}
+		fetched[mapURL.String()] = info
+
+		raw, err := l.load(mapURL.String())
+		if err != nil {
+			info.Error = err.Error()
+			continue
+		}
+
+		// Keep a copy of the map itself. Each map's sources are kept apart, as bundles often
+		// share source names such as webpack/bootstrap.
+		n := strconv.Itoa(len(fetched))
+		info.File = path.Join("maps", n+".map")
+		if err := os.MkdirAll(path.Join(d, "maps"), os.ModePerm); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(d, info.File), []byte(raw), 0644); err != nil {
+			return fmt.Errorf("failed to write source map to file: %v", err)
+		}
+
+		var sm sourceMap
+		if err := json.Unmarshal([]byte(raw), &sm); err != nil {
+			info.Error = fmt.Sprintf("failed to parse source map: %v", err)
+			continue
+		}
+		if err := t.reconstruct(l, &sm, mapURL, d, path.Join("src", n), info); err != nil {
+			info.Error = err.Error()
+		}
+	}
+
+	if len(infos) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(d, os.ModePerm); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode source maps manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(d, "manifest.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write source maps manifest: %v", err)
+	}
+
+	return nil
+}
+
+// reconstruct writes the original sources from a source map into the directory rel under d,
+// adding the paths written, relative to d, to info. Sources which aren't embedded in the map are fetched through the
+// browser where possible, and those which can't be are added to info's source errors.
+func (t *SourceMaps) reconstruct(l *resourceLoader, sm *sourceMap, mapURL *neturl.URL, d string, rel string, info *SourceMapInfo) error {
+	for _, s := range sm.Sections {
+		if s.Map != nil {
+			if err := t.reconstruct(l, s.Map, mapURL, d, rel, info); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, src := range sm.Sources {
+		src = joinSourceRoot(sm.SourceRoot, src)
+		var content string
+		if i < len(sm.SourcesContent) && sm.SourcesContent[i] != nil {
+			content = *sm.SourcesContent[i]
+		} else {
+			ref, err := neturl.Parse(src)
+			if err != nil {
+				info.SourceErrors = append(info.SourceErrors, fmt.Sprintf("%s: %v", src, err))
+				continue
+			}
+			u := mapURL.ResolveReference(ref)
+			if u.Scheme != "http" && u.Scheme != "https" {
+				info.SourceErrors = append(info.SourceErrors, fmt.Sprintf("%s: not embedded in the map, and can't be fetched", src))
+				continue
+			}
+			if content, err = l.load(u.String()); err != nil {
+				info.SourceErrors = append(info.SourceErrors, fmt.Sprintf("%s: %v", src, err))
+				continue
+			}
+		}
+
+		p := path.Join(rel, sourcePath(src))
+		full := path.Join(d, p)
+		if err := os.MkdirAll(path.Dir(full), os.ModePerm); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write source %s: %v", p, err)
+		}
+		info.Sources = append(info.Sources, p)
+	}
+	return nil
+}
+
+// joinSourceRoot prefixes a source with the map's sourceRoot, adding a separator if the root
+// doesn't end in one
+func joinSourceRoot(root string, src string) string {
+	if root != "" && !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	return root + src
+}
+
+// sourcePath converts the name of a source in a source map, such as
+// webpack:///./src/index.js, to a relative path that can't escape the output directory
+func sourcePath(src string) string {
+	if i := strings.Index(src, "://"); i >= 0 {
+		src = src[i+3:]
+	}
+	src = strings.SplitN(src, "?", 2)[0]
+	p := strings.TrimPrefix(path.Clean("/"+src), "/")
+	if p == "" {
+		return "unknown"
+	}
+	return p
+}
@@ -0,0 +1,200 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	neturl "net/url"
+	"path"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/security"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// CertificateInfo describes the TLS connection and certificate used for the main document
+type CertificateInfo struct {
+	URL               string    `json:"url"`
+	Protocol          string    `json:"protocol"`
+	KeyExchange       string    `json:"keyExchange,omitempty"`
+	Cipher            string    `json:"cipher"`
+	Subject           string    `json:"subject"`
+	SANs              []string  `json:"sans"`
+	Issuer            string    `json:"issuer"`
+	ValidFrom         time.Time `json:"validFrom"`
+	ValidTo           time.Time `json:"validTo"`
+	CTCompliance      string    `json:"ctCompliance"`
+	SCTs              int       `json:"scts"`
+	SecurityState     string    `json:"securityState"`
+	Chain             []string  `json:"chain,omitempty"`
+	Issues            []string  `json:"issues"`
+	IgnoredByInsecure bool      `json:"ignoredByInsecure"`
+}
+
+// The TLS task saves the details of the TLS certificate used for the page, and flags expired,
+// self-signed and mismatched certificates
+type TLS struct {
+	documentResponses
+	insecure bool
+}
+
+func (t *TLS) Priority() uint8 {
+	return 1
+}
+
+func (t *TLS) Slug() string {
+	return "tls"
+}
+
+func (t *TLS) Description() string {
+	return "Save the TLS certificate details of HTTPS pages, and flag expired, self-signed or mismatched certificates"
+}
+
+func (t *TLS) Init(c *config.Config) error {
+	t.insecure = c.Insecure
+	return nil
+}
+
+func (t *TLS) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	return t.listenDocuments(ctx)
+}
+
+func (t *TLS) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	doc := t.mainDocument()
+	if doc == nil || doc.Response.SecurityDetails == nil {
+		// Not an HTTPS page
+		return nil
+	}
+
+	r := doc.Response
+	d := r.SecurityDetails
+	info := &CertificateInfo{
+		URL:           r.URL,
+		Protocol:      d.Protocol,
+		KeyExchange:   d.KeyExchange,
+		Cipher:        d.Cipher,
+		Subject:       d.SubjectName,
+		SANs:          d.SanList,
+		Issuer:        d.Issuer,
+		CTCompliance:  d.CertificateTransparencyCompliance.String(),
+		SCTs:          len(d.SignedCertificateTimestampList),
+		SecurityState: r.SecurityState.String(),
+		Issues:        []string{},
+	}
+	if info.SANs == nil {
+		info.SANs = []string{}
+	}
+	if d.ValidFrom != nil {
+		info.ValidFrom = d.ValidFrom.Time()
+	}
+	if d.ValidTo != nil {
+		info.ValidTo = d.ValidTo.Time()
+	}
+
+	u, err := neturl.Parse(r.URL)
+	if err != nil {
+		return err
+	}
+
+	// The certificate chain gives more accurate results, but isn't always available
+	chain, _ := certificateChain(ctx, u)
+	for _, c := range chain {
+		info.Chain = append(info.Chain, c.Subject.String())
+	}
+
+	now := time.Now()
+	if !info.ValidTo.IsZero() && now.After(info.ValidTo) {
+		info.Issues = append(info.Issues, fmt.Sprintf("expired on %s", info.ValidTo.Format(time.RFC1123)))
+	}
+	if !info.ValidFrom.IsZero() && now.Before(info.ValidFrom) {
+		info.Issues = append(info.Issues, fmt.Sprintf("not valid until %s", info.ValidFrom.Format(time.RFC1123)))
+	}
+
+	var leaf *x509.Certificate
+	if len(chain) > 0 {
+		leaf = chain[0]
+	}
+	if leaf != nil {
+		if isSelfSigned(leaf) {
+			info.Issues = append(info.Issues, "self-signed")
+		}
+	} else if r.SecurityState == security.StateInsecure && info.Subject == info.Issuer {
+		// Without the chain only the common names are known, which intermediates can share, so
+		// this is only a guess when Chrome has rejected the certificate anyway
+		info.Issues = append(info.Issues, "possibly self-signed")
+	}
+
+	if leaf == nil {
+		leaf = &x509.Certificate{}
+		for _, san := range info.SANs {
+			if ip := net.ParseIP(san); ip != nil {
+				leaf.IPAddresses = append(leaf.IPAddresses, ip)
+			} else {
+				leaf.DNSNames = append(leaf.DNSNames, san)
+			}
+		}
+	}
+	if err := leaf.VerifyHostname(u.Hostname()); err != nil {
+		info.Issues = append(info.Issues, fmt.Sprintf("does not match hostname %s", u.Hostname()))
+	}
+
+	if r.SecurityState == security.StateInsecure && len(info.Issues) == 0 {
+		info.Issues = append(info.Issues, "rejected by Chrome")
+	}
+	info.IgnoredByInsecure = t.insecure && len(info.Issues) > 0
+
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode certificate details: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "tls.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate details to file: %v", err)
+	}
+	return nil
+}
+
+// isSelfSigned reports whether a certificate's issuer is its own subject, and it is signed by
+// its own key. CheckSignatureFrom isn't used, as it rejects certificates which aren't marked as
+// CAs, which many self-signed certificates aren't.
+func isSelfSigned(c *x509.Certificate) bool {
+	return bytes.Equal(c.RawSubject, c.RawIssuer) && c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil
+}
+
+// certificateChain returns the certificate chain presented by the origin of u
+func certificateChain(ctx context.Context, u *neturl.URL) ([]*x509.Certificate, error) {
+	var ders []string
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(c context.Context) error {
+		var err error
+		// Despite the name, the table names are the base64 encoded certificates
+		ders, err = network.GetCertificate(u.Scheme + "://" + u.Host).Do(c)
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*x509.Certificate
+	for _, d := range ders {
+		b, err := base64.StdEncoding.DecodeString(d)
+		if err != nil {
+			return nil, err
+		}
+		c, err := x509.ParseCertificate(b)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+func (t *TLS) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	return nil
+}
@@ -0,0 +1,136 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// WebSocketMessage is a single line of a WebSocket log
+type WebSocketMessage struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	URL     string    `json:"url,omitempty"`
+	Opcode  float64   `json:"opcode,omitempty"`
+	Payload string    `json:"payload,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// The WebSocket task logs the messages sent and received over any WebSockets opened by the page.
+// The first error writing the logs is kept, and returned by Teardown.
+type WebSocket struct {
+	mu      sync.Mutex
+	dir     string
+	sockets map[network.RequestID]string
+	err     error
+}
+
+func (t *WebSocket) Priority() uint8 {
+	return 1
+}
+
+func (t *WebSocket) Slug() string {
+	return "websockets"
+}
+
+func (t *WebSocket) Description() string {
+	return "Log messages sent and received over WebSockets while the page is loaded"
+}
+
+func (t *WebSocket) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *WebSocket) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.dir = path.Join(absDir, "websockets")
+	t.sockets = make(map[network.RequestID]string)
+	t.err = nil
+	t.mu.Unlock()
+
+	// Logs are appended to, so clear out any left by an earlier attempt at loading the page
+	if err := os.RemoveAll(t.dir); err != nil {
+		return fmt.Errorf("failed to clear WebSocket logs: %v", err)
+	}
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		switch ev := ev.(type) {
+		case *network.EventWebSocketCreated:
+			t.log(ev.RequestID, WebSocketMessage{Event: "created", URL: ev.URL})
+		case *network.EventWebSocketFrameSent:
+			t.log(ev.RequestID, WebSocketMessage{Event: "sent", Opcode: ev.Response.Opcode, Payload: ev.Response.PayloadData})
+		case *network.EventWebSocketFrameReceived:
+			t.log(ev.RequestID, WebSocketMessage{Event: "received", Opcode: ev.Response.Opcode, Payload: ev.Response.PayloadData})
+		case *network.EventWebSocketFrameError:
+			t.log(ev.RequestID, WebSocketMessage{Event: "error", Error: ev.ErrorMessage})
+		case *network.EventWebSocketClosed:
+			t.log(ev.RequestID, WebSocketMessage{Event: "closed"})
+		}
+	})
+
+	if err := chromedp.Run(ctx, network.Enable()); err != nil {
+		return fmt.Errorf("failed to enable network events: %v", err)
+	}
+	return nil
+}
+
+// log appends a message to the log file for the given socket, creating the file for sockets
+// that haven't been seen before.
+func (t *WebSocket) log(id network.RequestID, m WebSocketMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	name, ok := t.sockets[id]
+	if !ok {
+		name = fmt.Sprintf("socket-%d.jsonl", len(t.sockets))
+		t.sockets[id] = name
+	}
+
+	m.Time = time.Now()
+	if err := t.write(name, m); err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+// write appends a message to the log file with the given name
+func (t *WebSocket) write(name string, m WebSocketMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode WebSocket message: %v", err)
+	}
+
+	if err := os.MkdirAll(t.dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(t.dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open WebSocket log: %v", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write to WebSocket log: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write to WebSocket log: %v", err)
+	}
+	return nil
+}
+
+func (t *WebSocket) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	// Messages are logged as they arrive, so there's nothing left to do once the page has loaded
+	return nil
+}
+
+func (t *WebSocket) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
@@ -0,0 +1,302 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/serviceworker"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+	"github.com/danielthatcher/spydom/config"
+)
+
+// Worker types used in WorkerInfo, which match the types of their targets
+const (
+	WorkerDedicated = "worker"
+	WorkerShared    = "shared_worker"
+	WorkerService   = "service_worker"
+)
+
+// WorkerInfo describes a worker used by the page. File is the saved script, relative to the
+// page's output directory.
+type WorkerInfo struct {
+	Type          string            `json:"type"`
+	URL           string            `json:"url"`
+	TargetID      string            `json:"targetId,omitempty"`
+	Scope         string            `json:"scope,omitempty"`
+	RunningStatus string            `json:"runningStatus,omitempty"`
+	Status        string            `json:"status,omitempty"`
+	File          string            `json:"file,omitempty"`
+	Listeners     []*WorkerListener `json:"listeners"`
+	Errors        []string          `json:"errors,omitempty"`
+}
+
+// WorkerListener is an event listener on a worker's global scope
+type WorkerListener struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	UseCapture bool   `json:"useCapture"`
+	Passive    bool   `json:"passive"`
+	Once       bool   `json:"once"`
+	File       string `json:"file"`
+}
+
+// workerListenerTypes are the events whose listeners are extracted from workers. Shared workers
+// receive their ports through connect events, rather than receiving messages directly.
+var workerListenerTypes = []string{"message", "fetch", "connect"}
+
+// workerListenersJS returns the listeners of the given types on the worker's global scope. It
+// relies on getEventListeners from the DevTools command line API.
+const workerListenersJS = `
+	(function(types) {
+		let listeners = getEventListeners(self);
+		let ret = [];
+		types.forEach(function(t) {
+			(listeners[t] || []).forEach(function(l) {
+				ret.push({
+					type: t,
+					name: l.listener.name,
+					source: Function.prototype.toString.call(l.listener),
+					useCapture: l.useCapture,
+					passive: l.passive,
+					once: l.once
+				});
+			});
+		});
+		return ret;
+	})(%s)`
+
+// The Workers task saves the scripts and listeners of the service workers registered for the
+// page's origin, and of the dedicated and shared workers it starts
+type Workers struct {
+	mu            sync.Mutex
+	registrations map[serviceworker.RegistrationID]*serviceworker.Registration
+	versions      map[string]*serviceworker.Version
+	dedicated     map[target.ID]*target.Info
+	sessions      map[target.SessionID]target.ID
+}
+
+func (t *Workers) Priority() uint8 {
+	return 1
+}
+
+func (t *Workers) Slug() string {
+	return "workers"
+}
+
+func (t *Workers) Description() string {
+	return "Save the scripts and message and fetch listeners of the page's service workers, dedicated workers and shared workers"
+}
+
+func (t *Workers) Init(c *config.Config) error {
+	return nil
+}
+
+func (t *Workers) Preload(ctx context.Context, url string, absDir string, relDir string) error {
+	t.mu.Lock()
+	t.registrations = make(map[serviceworker.RegistrationID]*serviceworker.Registration)
+	t.versions = make(map[string]*serviceworker.Version)
+	t.dedicated = make(map[target.ID]*target.Info)
+	t.sessions = make(map[target.SessionID]target.ID)
+	t.mu.Unlock()
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		switch ev := ev.(type) {
+		case *serviceworker.EventWorkerRegistrationUpdated:
+			for _, r := range ev.Registrations {
+				t.registrations[r.RegistrationID] = r
+			}
+		case *serviceworker.EventWorkerVersionUpdated:
+			for _, v := range ev.Versions {
+				t.versions[v.VersionID] = v
+			}
+		case *target.EventAttachedToTarget:
+			// Dedicated workers aren't listed by Target.getTargets, but are auto-attached to
+			// Sessions attached to by the task itself are for workers that are already known
+			if _, ok := t.dedicated[ev.TargetInfo.TargetID]; !ok && ev.TargetInfo.Type == WorkerDedicated {
+				t.dedicated[ev.TargetInfo.TargetID] = ev.TargetInfo
+				t.sessions[ev.SessionID] = ev.TargetInfo.TargetID
+			}
+		case *target.EventDetachedFromTarget:
+			// The worker has terminated
+			if id, ok := t.sessions[ev.SessionID]; ok {
+				delete(t.dedicated, id)
+				delete(t.sessions, ev.SessionID)
+			}
+		}
+	})
+
+	if err := chromedp.Run(ctx, serviceworker.Enable()); err != nil {
+		return fmt.Errorf("failed to enable service worker events: %v", err)
+	}
+	return nil
+}
+
+func (t *Workers) Run(ctx context.Context, url string, absDir string, relDir string) error {
+	var loc string
+	if err := chromedp.Run(ctx, chromedp.Location(&loc)); err != nil {
+		return fmt.Errorf("failed to retrieve page location: %v", err)
+	}
+	page, err := neturl.Parse(loc)
+	if err != nil {
+		return err
+	}
+
+	targets, err := workerTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	workers := []*WorkerInfo{}
+	seen := make(map[string]bool)
+	add := func(w *WorkerInfo) {
+		if w.TargetID != "" {
+			if seen[w.TargetID] {
+				return
+			}
+			seen[w.TargetID] = true
+		}
+		workers = append(workers, w)
+	}
+
+	// Registrations are shared by every page in the browser, so only those for the page's
+	// origin are included
+	t.mu.Lock()
+	for _, v := range t.versions {
+		r, ok := t.registrations[v.RegistrationID]
+		if !ok || r.IsDeleted || v.Status == serviceworker.VersionStatusRedundant || !sameOrigin(r.ScopeURL, page) {
+			continue
+		}
+		add(&WorkerInfo{
+			Type:          WorkerService,
+			URL:           v.ScriptURL,
+			TargetID:      string(v.TargetID),
+			Scope:         r.ScopeURL,
+			RunningStatus: v.RunningStatus.String(),
+			Status:        v.Status.String(),
+		})
+	}
+	for _, info := range t.dedicated {
+		add(&WorkerInfo{Type: info.Type, URL: info.URL, TargetID: string(info.TargetID)})
+	}
+	t.mu.Unlock()
+	for _, info := range targets {
+		add(&WorkerInfo{Type: info.Type, URL: info.URL, TargetID: string(info.TargetID)})
+	}
+
+	sort.Slice(workers, func(i, j int) bool {
+		if workers[i].Type != workers[j].Type {
+			return workers[i].Type < workers[j].Type
+		}
+		return workers[i].URL < workers[j].URL
+	})
+
+	for i, w := range workers {
+		rel := path.Join("workers", strconv.Itoa(i+1))
+		d := path.Join(absDir, rel)
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			return err
+		}
+
+		w.Listeners = []*WorkerListener{}
+		if src, err := fetchInPage(ctx, w.URL); err != nil {
+			w.Errors = append(w.Errors, err.Error())
+		} else if err := writeBeautified(path.Join(d, "script.js"), src); err != nil {
+			return fmt.Errorf("failed to save worker script %s: %v", w.URL, err)
+		} else {
+			w.File = path.Join(rel, "script.js")
+		}
+
+		if w.TargetID == "" {
+			w.Errors = append(w.Errors, "the worker isn't running, so its listeners could not be extracted")
+			continue
+		}
+		if err := t.saveListeners(ctx, w, d, rel); err != nil {
+			w.Errors = append(w.Errors, fmt.Sprintf("failed to extract listeners: %v", err))
+		}
+	}
+
+	b, err := json.MarshalIndent(workers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode workers: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(absDir, "workers.json"), b, 0644); err != nil {
+		return fmt.Errorf("failed to write workers to file: %v", err)
+	}
+	return nil
+}
+
+// saveListeners extracts the listeners on the worker's global scope, saving each one in the
+// directory d
+func (t *Workers) saveListeners(ctx context.Context, w *WorkerInfo, d string, rel string) error {
+	s, err := attachSession(ctx, target.ID(w.TargetID))
+	if err != nil {
+		return err
+	}
+	defer s.detach(ctx)
+
+	typesJSON, err := json.Marshal(workerListenerTypes)
+	if err != nil {
+		return err
+	}
+	res, exp, err := runtime.Evaluate(fmt.Sprintf(workerListenersJS, typesJSON)).
+		WithIncludeCommandLineAPI(true).
+		WithReturnByValue(true).
+		Do(cdp.WithExecutor(ctx, s))
+	if err != nil {
+		return err
+	}
+	if exp != nil {
+		return exp
+	}
+
+	var listeners []struct {
+		WorkerListener
+		Source string `json:"source"`
+	}
+	if err := json.Unmarshal(res.Value, &listeners); err != nil {
+		return fmt.Errorf("failed to decode listeners: %v", err)
+	}
+
+	// Give each listener a unique name that can be used as a filename
+	names := make(map[string]int)
+	for _, l := range listeners {
+		name := safeFilename(l.Name)
+		if name == "" {
+			name = "unnamed"
+		}
+		name = safeFilename(l.Type) + "-" + name
+		names[name]++
+		if names[name] > 1 {
+			name = fmt.Sprintf("%s%d", name, names[name]-1)
+		}
+
+		if err := writeBeautified(path.Join(d, name), l.Source); err != nil {
+			return err
+		}
+		wl := l.WorkerListener
+		wl.File = path.Join(rel, name)
+		w.Listeners = append(w.Listeners, &wl)
+	}
+	return nil
+}
+
+func (t *Workers) Teardown(ctx context.Context, url string, absDir string, relDir string) error {
+	if err := chromedp.Run(ctx, serviceworker.Disable()); err != nil {
+		return fmt.Errorf("failed to disable service worker events: %v", err)
+	}
+	return nil
+}